@@ -2,4 +2,7 @@ module arsenal-os
 
 go 1.16
 
-require github.com/moby/sys/mountinfo v0.6.2
+require (
+	github.com/moby/sys/mountinfo v0.6.2
+	golang.org/x/sys v0.0.0-20220520151302-bc2c85ada10a
+)
@@ -0,0 +1,37 @@
+/*
+Copyright 2023 Sangfor Technologies Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package operations
+
+import (
+	"fmt"
+
+	"arsenal-os/submodules"
+)
+
+func init() {
+	submodules.FaultOperationTypes[submodules.Status] = status
+}
+
+func status(faultType submodules.FaultOperations, inputArgs []string) error {
+	// 状态查询为可选能力，只有实现了FaultStatus接口的故障模式支持。
+	reporter, ok := faultType.(submodules.FaultStatus)
+	if !ok {
+		return fmt.Errorf("fault type: %s-%s does not support status operation",
+			inputArgs[submodules.ModuleNameIndex], inputArgs[submodules.FaultTypeIndex])
+	}
+	return reporter.FaultStatus(inputArgs)
+}
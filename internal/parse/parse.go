@@ -19,6 +19,7 @@ package parse
 import (
 	"fmt"
 	"sort"
+	"strconv"
 	"strings"
 )
 
@@ -69,3 +70,16 @@ func TransInputFlagsToString(args []string) string {
 	}
 	return flagsString
 }
+
+// GetBoolFlag 获取布尔类型参数的值，如：--force true，参数不存在时返回false。
+func GetBoolFlag(flags map[string]string, name string) (bool, error) {
+	value, ok := flags[name]
+	if !ok {
+		return false, nil
+	}
+	result, err := strconv.ParseBool(value)
+	if err != nil {
+		return false, fmt.Errorf("trans %s param(%s) to bool failed: %v", name, value, err)
+	}
+	return result, nil
+}
@@ -25,6 +25,8 @@ import (
 	_ "arsenal-os/submodules/file"
 	// 向全局故障相关操作接口map中添加filesystem类型接口
 	_ "arsenal-os/submodules/filesystem"
+	// 向全局故障相关操作接口map中添加kernel类型接口
+	_ "arsenal-os/submodules/kernel"
 	// 向全局故障相关操作接口map中添加memory类型接口
 	_ "arsenal-os/submodules/memory"
 	// 向全局故障相关操作接口map中添加process类型接口
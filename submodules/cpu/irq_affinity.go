@@ -0,0 +1,340 @@
+/*
+Copyright 2023 Sangfor Technologies Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cpu
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"arsenal-os/internal/parse"
+	"arsenal-os/submodules"
+	"arsenal-os/util"
+)
+
+func init() {
+	var newFaultType = irqAffinity{
+		FaultType: "cpu-irq-affinity",
+	}
+	submodules.Add(newFaultType.FaultType, &newFaultType)
+}
+
+const procInterruptsPath = "/proc/interrupts"
+
+type irqAffinity struct {
+	FaultType string
+	flags     map[string]string
+	irqList   []int
+	cpuList   []int
+}
+
+// irqAffinityBackup 记录被修改中断的原始亲和性以及注入时各cpu上的中断计数，key为中断号。
+type irqAffinityBackup struct {
+	AffinityList map[int]string
+	Counts       map[int]map[int]uint64
+}
+
+// irqInfo /proc/interrupts中单个中断的信息。
+type irqInfo struct {
+	counts map[int]uint64
+	name   string
+}
+
+// readInterrupts 解析/proc/interrupts，只返回数字编号的中断，key为中断号。
+func readInterrupts() (map[int]irqInfo, error) {
+	file, err := os.Open(procInterruptsPath)
+	if err != nil {
+		return nil, fmt.Errorf("open %s failed: %v", procInterruptsPath, err)
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	if !scanner.Scan() {
+		return nil, fmt.Errorf("read %s header failed", procInterruptsPath)
+	}
+	// 表头只包含online状态的cpu，如：CPU0 CPU2 CPU3。
+	var cpuIDs []int
+	for _, field := range strings.Fields(scanner.Text()) {
+		cpuID, err := strconv.Atoi(strings.TrimPrefix(field, "CPU"))
+		if err != nil {
+			return nil, fmt.Errorf("parse %s header field %s failed: %v", procInterruptsPath, field, err)
+		}
+		cpuIDs = append(cpuIDs, cpuID)
+	}
+
+	interrupts := make(map[int]irqInfo)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 {
+			continue
+		}
+		irq, err := strconv.Atoi(strings.TrimSuffix(fields[0], ":"))
+		if err != nil {
+			continue
+		}
+
+		info := irqInfo{counts: make(map[int]uint64, len(cpuIDs))}
+		for index, cpuID := range cpuIDs {
+			if index+1 >= len(fields) {
+				break
+			}
+			count, err := strconv.ParseUint(fields[index+1], 10, 64)
+			if err != nil {
+				break
+			}
+			info.counts[cpuID] = count
+		}
+		if len(fields) > len(cpuIDs)+1 {
+			info.name = strings.Join(fields[len(cpuIDs)+1:], " ")
+		}
+		interrupts[irq] = info
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("read %s failed: %v", procInterruptsPath, err)
+	}
+	return interrupts, nil
+}
+
+func irqAffinityListPath(irq int) string {
+	return fmt.Sprintf("/proc/irq/%d/smp_affinity_list", irq)
+}
+
+// irqListParser 获取需要修改亲和性的中断，--irq指定中断号，--irq-name按/proc/interrupts中的名称正则匹配。
+func (i *irqAffinity) irqListParser() error {
+	irqString, hasIrq := i.flags["irq"]
+	irqName, hasIrqName := i.flags["irq-name"]
+	if !hasIrq && !hasIrqName {
+		return errors.New("please input param irq or irq-name")
+	}
+
+	interrupts, err := readInterrupts()
+	if err != nil {
+		return err
+	}
+
+	selected := make(map[int]bool)
+	if hasIrq {
+		for _, part := range strings.Split(irqString, ",") {
+			irq, err := strconv.Atoi(part)
+			if err != nil {
+				return fmt.Errorf("trans irq(%s) to int failed: %v", part, err)
+			}
+			if _, ok := interrupts[irq]; !ok {
+				return fmt.Errorf("irq %d not found in %s", irq, procInterruptsPath)
+			}
+			selected[irq] = true
+		}
+	}
+	if hasIrqName {
+		re, err := regexp.Compile(irqName)
+		if err != nil {
+			return fmt.Errorf("compile irq-name(%s) failed: %v", irqName, err)
+		}
+		for irq, info := range interrupts {
+			if !re.MatchString(info.name) {
+				continue
+			}
+			// 按名称匹配到的中断可能不支持修改亲和性(如cascade)，跳过该中断。
+			if !util.FileIsExist(irqAffinityListPath(irq)) {
+				continue
+			}
+			selected[irq] = true
+		}
+	}
+
+	for irq := range selected {
+		if !util.FileIsExist(irqAffinityListPath(irq)) {
+			return fmt.Errorf("irq %d has no affinity control file: %s", irq, irqAffinityListPath(irq))
+		}
+		i.irqList = append(i.irqList, irq)
+	}
+	if len(i.irqList) == 0 {
+		return fmt.Errorf("no irq matches %s", irqName)
+	}
+	sort.Ints(i.irqList)
+	return nil
+}
+
+func (i *irqAffinity) cpuListParser() error {
+	cpuListString, ok := i.flags["cpu-list"]
+	if !ok {
+		return errors.New("please input param cpu-list")
+	}
+	cpuList, err := util.ParseCPUList(cpuListString)
+	if err != nil {
+		return fmt.Errorf("cpu-list param error: %v", err)
+	}
+	// 注入时写入包含offline cpu的列表会返回EINVAL，此时注入记录已经保存，会阻止下一次注入。
+	if err := util.CheckCPUListOnline(cpuList); err != nil {
+		return err
+	}
+	i.cpuList = cpuList
+	return nil
+}
+
+func (i *irqAffinity) Prepare(inputArgs []string) error {
+	i.flags = parse.TransInputFlagsToMap(inputArgs)
+	// 清理和状态查询都依据注入时保存的记录执行。
+	opsType := inputArgs[submodules.OpsTypeIndex]
+	if opsType == submodules.Remove || opsType == submodules.Status {
+		return nil
+	}
+
+	if err := i.irqListParser(); err != nil {
+		return fmt.Errorf("parser irq failed: %v", err)
+	}
+	if err := i.cpuListParser(); err != nil {
+		return fmt.Errorf("parser cpu id failed: %v", err)
+	}
+
+	// irqbalance会周期性重新分配中断亲和性，导致故障效果被覆盖。
+	if result, err := util.ExecCommandBlock("pidof irqbalance"); err == nil && result != "" {
+		return errors.New("irqbalance is running and will override irq affinity, please stop it first")
+	}
+	return nil
+}
+
+func (i *irqAffinity) FaultInject(_ []string) error {
+	if util.StateIsExist(i.FaultType) {
+		return fmt.Errorf("%s fault has been injected", i.FaultType)
+	}
+
+	interrupts, err := readInterrupts()
+	if err != nil {
+		return err
+	}
+	backup := irqAffinityBackup{
+		AffinityList: make(map[int]string, len(i.irqList)),
+		Counts:       make(map[int]map[int]uint64, len(i.irqList)),
+	}
+	for _, irq := range i.irqList {
+		data, err := ioutil.ReadFile(irqAffinityListPath(irq))
+		if err != nil {
+			return fmt.Errorf("read irq %d affinity failed: %v", irq, err)
+		}
+		backup.AffinityList[irq] = strings.TrimSpace(string(data))
+		backup.Counts[irq] = interrupts[irq].counts
+	}
+	if err := util.SaveState(i.FaultType, &backup); err != nil {
+		return err
+	}
+
+	cpuListString := util.FormatCPUList(i.cpuList)
+	for _, irq := range i.irqList {
+		err := ioutil.WriteFile(irqAffinityListPath(irq), []byte(cpuListString), 0)
+		if err == nil {
+			continue
+		}
+		// 内核托管的中断(如nvme队列中断)不允许修改亲和性，写入返回EIO，跳过该中断。
+		if pathErr, ok := err.(*os.PathError); ok && pathErr.Err == syscall.EIO {
+			delete(backup.AffinityList, irq)
+			delete(backup.Counts, irq)
+			continue
+		}
+		return fmt.Errorf("set irq %d affinity to %s failed: %v", irq, cpuListString, err)
+	}
+
+	if len(backup.AffinityList) == 0 {
+		if err := util.RemoveState(i.FaultType); err != nil {
+			return err
+		}
+		return errors.New("no irq affinity has been changed")
+	}
+	return util.SaveState(i.FaultType, &backup)
+}
+
+func (i *irqAffinity) FaultRemove(_ []string) error {
+	var backup irqAffinityBackup
+	if err := util.LoadState(i.FaultType, &backup); err != nil {
+		return fmt.Errorf("%s load raw irq affinity failed: %v", i.FaultType, err)
+	}
+
+	for irq, affinityList := range backup.AffinityList {
+		// 中断可能已经随设备一起被移除。
+		if !util.FileIsExist(irqAffinityListPath(irq)) {
+			continue
+		}
+		if err := ioutil.WriteFile(irqAffinityListPath(irq), []byte(affinityList), 0); err != nil {
+			return fmt.Errorf("restore irq %d affinity to %s failed: %v", irq, affinityList, err)
+		}
+	}
+	return util.RemoveState(i.FaultType)
+}
+
+// FaultStatus 输出被修改中断在注入后各cpu上新增的中断次数。
+func (i *irqAffinity) FaultStatus(_ []string) error {
+	var backup irqAffinityBackup
+	if err := util.LoadState(i.FaultType, &backup); err != nil {
+		return fmt.Errorf("%s load inject record failed: %v", i.FaultType, err)
+	}
+	interrupts, err := readInterrupts()
+	if err != nil {
+		return err
+	}
+
+	cpuIDs, err := util.GetOnlineCPUList()
+	if err != nil {
+		return err
+	}
+	irqList := make([]int, 0, len(backup.Counts))
+	for irq := range backup.Counts {
+		irqList = append(irqList, irq)
+	}
+	sort.Ints(irqList)
+
+	var builder strings.Builder
+	builder.WriteString(fmt.Sprintf("%-8s", "IRQ"))
+	for _, cpuID := range cpuIDs {
+		builder.WriteString(fmt.Sprintf("%12s", fmt.Sprintf("CPU%d", cpuID)))
+	}
+	builder.WriteString("  NAME\n")
+
+	totals := make(map[int]uint64, len(cpuIDs))
+	for _, irq := range irqList {
+		info, ok := interrupts[irq]
+		if !ok {
+			continue
+		}
+		builder.WriteString(fmt.Sprintf("%-8d", irq))
+		for _, cpuID := range cpuIDs {
+			var delta uint64
+			// 计数在cpu下线后重新上线时可能归零，按当前值计算。
+			if current, before := info.counts[cpuID], backup.Counts[irq][cpuID]; current >= before {
+				delta = current - before
+			} else {
+				delta = current
+			}
+			totals[cpuID] += delta
+			builder.WriteString(fmt.Sprintf("%12d", delta))
+		}
+		builder.WriteString(fmt.Sprintf("  %s\n", info.name))
+	}
+
+	builder.WriteString(fmt.Sprintf("%-8s", "TOTAL"))
+	for _, cpuID := range cpuIDs {
+		builder.WriteString(fmt.Sprintf("%12d", totals[cpuID]))
+	}
+	fmt.Println(builder.String())
+	return nil
+}
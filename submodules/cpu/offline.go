@@ -19,9 +19,13 @@ package cpu
 import (
 	"errors"
 	"fmt"
-	"regexp"
+	"io/ioutil"
+	"math"
+	"math/rand"
+	"sort"
 	"strconv"
 	"strings"
+	"time"
 
 	"arsenal-os/internal/parse"
 	"arsenal-os/submodules"
@@ -36,14 +40,34 @@ func init() {
 }
 
 type offline struct {
-	FaultType string
-	flags     map[string]string
-	cpuList   []int
+	FaultType        string
+	flags            map[string]string
+	cpuList          []int
+	protectedCPUList []int
+	onlineCPUList    []int
 }
 
-func (o *offline) isDuplicateCPUID(checkID int64) bool {
-	for _, id := range o.cpuList {
-		if id == int(checkID) {
+// offlineBackup 记录注入时实际被下线的cpu，清理时只上线这些cpu。
+type offlineBackup struct {
+	OfflineCPUList []int
+}
+
+func cpuOnlineCtlPath(cpuID int) string {
+	return fmt.Sprintf("/sys/devices/system/cpu/cpu%d/online", cpuID)
+}
+
+// cpuIsOnline 读取cpu的online控制文件获取当前状态。
+func cpuIsOnline(cpuID int) (bool, error) {
+	data, err := ioutil.ReadFile(cpuOnlineCtlPath(cpuID))
+	if err != nil {
+		return false, fmt.Errorf("read cpu %d online state failed: %v", cpuID, err)
+	}
+	return strings.TrimSpace(string(data)) == "1", nil
+}
+
+func containsCPUID(cpuList []int, cpuID int) bool {
+	for _, id := range cpuList {
+		if id == cpuID {
 			return true
 		}
 	}
@@ -53,94 +77,206 @@ func (o *offline) isDuplicateCPUID(checkID int64) bool {
 func (o *offline) cpuListParser() error {
 	cpuListString, ok := o.flags["cpuid"]
 	if !ok {
-		return errors.New("please input param cpuid")
-	}
-	re := regexp.MustCompile(`^(\d+(-\d+)?)(,\d+(-\d+)?)*$`)
-	if !re.MatchString(cpuListString) {
-		return fmt.Errorf("cpuid param format error: %s", cpuListString)
-	}
-
-	// 将字符串按逗号分隔成多个子串。
-	parts := strings.Split(cpuListString, ",")
-	for _, part := range parts {
-		// 判断子串中是否包含连字符。
-		if strings.Contains(part, "-") {
-			// 将子串按连字符分隔成两个数字。
-			rangeParts := strings.Split(part, "-")
-			start, err := strconv.ParseInt(rangeParts[0], 10, 64)
-			if err != nil {
-				return fmt.Errorf("trans cpu range starting id to int failed: %v", err)
-			}
-			end, err := strconv.ParseInt(rangeParts[1], 10, 64)
-			if err != nil {
-				return fmt.Errorf("trans cpu range ending id to int failed: %v", err)
-			}
-			if start > end {
-				return fmt.Errorf("cpu range starting id is larger than ending id: %s", part)
-			}
-			// 将两个数字之间的所有整数加入数组。
-			for i := start; i <= end; i++ {
-				if o.isDuplicateCPUID(i) {
-					return fmt.Errorf("duplicate cpu id: %d", i)
-				}
-				o.cpuList = append(o.cpuList, int(i))
-			}
-		} else {
-			// 将子串转换为整数并加入数组。
-			num, err := strconv.ParseInt(part, 10, 64)
-			if err != nil {
-				return fmt.Errorf("trans single cpu id string to int failed: %v", err)
-			}
-			if o.isDuplicateCPUID(num) {
-				return fmt.Errorf("duplicate cpu id: %d", num)
-			}
-			o.cpuList = append(o.cpuList, int(num))
-		}
+		return errors.New("please input param cpuid, count or percent")
+	}
+	cpuList, err := util.ParseCPUList(cpuListString)
+	if err != nil {
+		return fmt.Errorf("cpuid param error: %v", err)
+	}
+	o.cpuList = cpuList
+	return nil
+}
+
+func (o *offline) protectedCPUListParser() error {
+	cpuListString, ok := o.flags["protected-cpuid"]
+	if !ok {
+		return nil
+	}
+	cpuList, err := util.ParseCPUList(cpuListString)
+	if err != nil {
+		return fmt.Errorf("protected-cpuid param error: %v", err)
+	}
+	o.protectedCPUList = cpuList
+	return nil
+}
+
+// cpuHotplugCheck 检查cpu是否存在以及是否支持热插拔，cpu0等不支持热插拔的cpu没有online控制文件。
+func cpuHotplugCheck(cpuID int) error {
+	cpuPath := fmt.Sprintf("/sys/devices/system/cpu/cpu%d", cpuID)
+	if !util.FileIsExist(cpuPath) {
+		return fmt.Errorf("cpu %d does not exist", cpuID)
+	}
+	if !util.FileIsExist(cpuOnlineCtlPath(cpuID)) {
+		return fmt.Errorf("cpu %d does not support hotplug", cpuID)
 	}
 	return nil
 }
 
 func (o *offline) cpuExistenceCheck() error {
 	for _, cpuID := range o.cpuList {
-		offlineCtlPath := fmt.Sprintf("/sys/devices/system/cpu/cpu%d/online", cpuID)
-		if !util.FileIsExist(offlineCtlPath) {
-			return fmt.Errorf("can not found offline control file path: %s", offlineCtlPath)
+		if err := cpuHotplugCheck(cpuID); err != nil {
+			return err
+		}
+		if containsCPUID(o.protectedCPUList, cpuID) {
+			return fmt.Errorf("cpu %d is protected", cpuID)
+		}
+	}
+	return nil
+}
+
+// randomCPUListSelector 从可下线的cpu中随机选择--count个或--percent比例的cpu。
+func (o *offline) randomCPUListSelector() error {
+	var count int
+	if countStr, ok := o.flags["count"]; ok {
+		value, err := strconv.Atoi(countStr)
+		if err != nil || value <= 0 {
+			return fmt.Errorf("count param(%s) must be a positive integer", countStr)
+		}
+		count = value
+	} else {
+		percentStr := o.flags["percent"]
+		percent, err := strconv.ParseFloat(percentStr, 64)
+		if err != nil || percent <= 0 || percent > 100 {
+			return fmt.Errorf("percent param(%s) must be in range (0, 100]", percentStr)
+		}
+		count = int(math.Ceil(float64(len(o.onlineCPUList)) * percent / 100))
+	}
+
+	var candidates []int
+	for _, cpuID := range o.onlineCPUList {
+		if cpuHotplugCheck(cpuID) != nil || containsCPUID(o.protectedCPUList, cpuID) {
+			continue
 		}
+		candidates = append(candidates, cpuID)
+	}
+	if count > len(candidates) {
+		return fmt.Errorf("only %d cpu can be offline, less than %d", len(candidates), count)
+	}
+
+	random := rand.New(rand.NewSource(time.Now().UnixNano()))
+	for _, index := range random.Perm(len(candidates))[:count] {
+		o.cpuList = append(o.cpuList, candidates[index])
 	}
+	sort.Ints(o.cpuList)
 	return nil
 }
 
+// lastOnlineCPUCheck 至少保留一个online状态的cpu。
+func (o *offline) lastOnlineCPUCheck() error {
+	for _, cpuID := range o.onlineCPUList {
+		if !containsCPUID(o.cpuList, cpuID) {
+			return nil
+		}
+	}
+	return errors.New("refuse to offline the last online cpu")
+}
+
 func (o *offline) Prepare(inputArgs []string) error {
 	if missingCmd, isMissCmd := util.CheckEnvShellCommand([]string{"echo"}); isMissCmd {
 		return fmt.Errorf("missing command: %s", missingCmd)
 	}
 
 	o.flags = parse.TransInputFlagsToMap(inputArgs)
-	if err := o.cpuListParser(); err != nil {
-		return fmt.Errorf("parser cpu id failed: %v", err)
+	// 清理时只上线注入时记录的cpu，不需要解析参数。
+	if inputArgs[submodules.OpsTypeIndex] == submodules.Remove {
+		return nil
 	}
 
-	if err := o.cpuExistenceCheck(); err != nil {
-		return fmt.Errorf("cpu existence check failed: %v", err)
+	if err := o.protectedCPUListParser(); err != nil {
+		return fmt.Errorf("parser protected cpu id failed: %v", err)
 	}
-	return nil
-}
+	onlineCPUList, err := util.GetOnlineCPUList()
+	if err != nil {
+		return err
+	}
+	o.onlineCPUList = onlineCPUList
 
-func (o *offline) executor(magic string) error {
-	for _, cpuID := range o.cpuList {
-		offlineCtlPath := fmt.Sprintf("/sys/devices/system/cpu/cpu%d/online", cpuID)
-		shellCmd := fmt.Sprintf("echo %s > %s", magic, offlineCtlPath)
-		if result, err := util.ExecCommandBlock(shellCmd); err != nil {
-			return fmt.Errorf("execute %s failed, error: %s, result: %s", shellCmd, err, result)
+	_, hasCount := o.flags["count"]
+	_, hasPercent := o.flags["percent"]
+	if hasCount || hasPercent {
+		if err := o.randomCPUListSelector(); err != nil {
+			return fmt.Errorf("select cpu failed: %v", err)
+		}
+	} else {
+		if err := o.cpuListParser(); err != nil {
+			return fmt.Errorf("parser cpu id failed: %v", err)
 		}
+		if err := o.cpuExistenceCheck(); err != nil {
+			return fmt.Errorf("cpu existence check failed: %v", err)
+		}
+	}
+	return o.lastOnlineCPUCheck()
+}
+
+func (o *offline) executor(cpuID int, magic string) error {
+	shellCmd := fmt.Sprintf("echo %s > %s", magic, cpuOnlineCtlPath(cpuID))
+	if result, err := util.ExecCommandBlock(shellCmd); err != nil {
+		return fmt.Errorf("execute %s failed, error: %s, result: %s", shellCmd, err, result)
 	}
 	return nil
 }
 
 func (o *offline) FaultInject(_ []string) error {
-	return o.executor("0")
+	if util.StateIsExist(o.FaultType) {
+		return fmt.Errorf("%s fault has been injected", o.FaultType)
+	}
+
+	// 只记录由本次注入下线的cpu，注入前已经offline的cpu清理时保持原状。
+	var backup offlineBackup
+	var injectErr error
+	for _, cpuID := range o.cpuList {
+		isOnline, err := cpuIsOnline(cpuID)
+		if err != nil {
+			injectErr = err
+			break
+		}
+		if !isOnline {
+			continue
+		}
+		if err := o.executor(cpuID, "0"); err != nil {
+			injectErr = err
+			break
+		}
+		backup.OfflineCPUList = append(backup.OfflineCPUList, cpuID)
+	}
+
+	if len(backup.OfflineCPUList) != 0 {
+		if err := util.SaveState(o.FaultType, &backup); err != nil {
+			return err
+		}
+		fmt.Printf("offline cpu: %s\n", util.FormatCPUList(backup.OfflineCPUList))
+	}
+	if injectErr != nil {
+		return injectErr
+	}
+	if len(backup.OfflineCPUList) == 0 {
+		return errors.New("all selected cpu are already offline")
+	}
+	return nil
 }
 
 func (o *offline) FaultRemove(_ []string) error {
-	return o.executor("1")
+	var backup offlineBackup
+	if err := util.LoadState(o.FaultType, &backup); err != nil {
+		return fmt.Errorf("%s load inject record failed: %v", o.FaultType, err)
+	}
+
+	var onlineCPUList []int
+	for _, cpuID := range backup.OfflineCPUList {
+		isOnline, err := cpuIsOnline(cpuID)
+		if err != nil {
+			return err
+		}
+		if isOnline {
+			continue
+		}
+		if err := o.executor(cpuID, "1"); err != nil {
+			return err
+		}
+		onlineCPUList = append(onlineCPUList, cpuID)
+	}
+	if len(onlineCPUList) != 0 {
+		fmt.Printf("online cpu: %s\n", util.FormatCPUList(onlineCPUList))
+	}
+	return util.RemoveState(o.FaultType)
 }
@@ -0,0 +1,135 @@
+/*
+Copyright 2023 Sangfor Technologies Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package kernel
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"arsenal-os/submodules"
+	"arsenal-os/util"
+)
+
+func init() {
+	// 内核函数返回错误故障，只支持injectable中列出的函数。
+	var newFaultType = failFunction{
+		faultInjection: faultInjection{
+			FaultType: "kernel-fail-function",
+			name:      "fail_function",
+			config:    "CONFIG_FUNCTION_ERROR_INJECTION and CONFIG_FAIL_FUNCTION",
+		},
+	}
+	submodules.Add(newFaultType.FaultType, &newFaultType)
+}
+
+type failFunction struct {
+	faultInjection
+	function string
+	retval   string
+}
+
+// failFunctionRecord 记录添加到inject中的函数，清理时移除。
+type failFunctionRecord struct {
+	Function string
+}
+
+func (f *failFunction) functionStateName() string {
+	return fmt.Sprintf("%s-function", f.FaultType)
+}
+
+// injectableCheck 检查函数是否在injectable列表中，行格式为：函数名 错误类型。
+func (f *failFunction) injectableCheck() error {
+	injectable, err := readKnob(filepath.Join(f.dir(), "injectable"))
+	if err != nil {
+		return err
+	}
+	for _, line := range strings.Split(injectable, "\n") {
+		if fields := strings.Fields(line); len(fields) != 0 && fields[0] == f.function {
+			return nil
+		}
+	}
+	return fmt.Errorf("function %s is not injectable, see %s", f.function, filepath.Join(f.dir(), "injectable"))
+}
+
+func (f *failFunction) Prepare(inputArgs []string) error {
+	if err := f.faultInjection.Prepare(inputArgs); err != nil {
+		return err
+	}
+	if inputArgs[submodules.OpsTypeIndex] == submodules.Remove {
+		return nil
+	}
+
+	function, ok := f.flags["function"]
+	if !ok {
+		return errors.New("please input param function")
+	}
+	f.function = function
+	if err := f.injectableCheck(); err != nil {
+		return err
+	}
+	if retval, ok := f.flags["retval"]; ok {
+		if _, err := strconv.ParseInt(retval, 0, 64); err != nil {
+			return fmt.Errorf("retval param(%s) must be an integer, example: -12", retval)
+		}
+		f.retval = retval
+	}
+	return nil
+}
+
+func (f *failFunction) FaultInject(inputArgs []string) error {
+	if util.StateIsExist(f.functionStateName()) {
+		return fmt.Errorf("%s fault has been injected", f.FaultType)
+	}
+	record := failFunctionRecord{Function: f.function}
+	if err := util.SaveState(f.functionStateName(), &record); err != nil {
+		return err
+	}
+
+	// 函数添加到inject后才会创建对应的retval文件。
+	if err := writeKnob(filepath.Join(f.dir(), "inject"), f.function); err != nil {
+		return err
+	}
+	if f.retval != "" {
+		if err := writeKnob(filepath.Join(f.dir(), f.function, "retval"), f.retval); err != nil {
+			return err
+		}
+	}
+	return f.faultInjection.FaultInject(inputArgs)
+}
+
+func (f *failFunction) FaultRemove(inputArgs []string) error {
+	if err := f.faultInjection.FaultRemove(inputArgs); err != nil {
+		return err
+	}
+	if !util.StateIsExist(f.functionStateName()) {
+		return nil
+	}
+	var record failFunctionRecord
+	if err := util.LoadState(f.functionStateName(), &record); err != nil {
+		return err
+	}
+	// 向inject写入"!函数名"移除该函数。
+	if util.FileIsExist(filepath.Join(f.dir(), record.Function)) {
+		if err := writeKnob(filepath.Join(f.dir(), "inject"), "!"+record.Function); err != nil {
+			return err
+		}
+	}
+	return util.RemoveState(f.functionStateName())
+}
@@ -0,0 +1,30 @@
+/*
+Copyright 2023 Sangfor Technologies Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package kernel
+
+import "arsenal-os/submodules"
+
+func init() {
+	// futex操作失败故障，可用于测试用户态锁的异常处理。
+	var newFaultType = faultInjection{
+		FaultType: "kernel-fail-futex",
+		name:      "fail_futex",
+		config:    "CONFIG_FAIL_FUTEX",
+		boolKnobs: []string{"ignore-private"},
+	}
+	submodules.Add(newFaultType.FaultType, &newFaultType)
+}
@@ -0,0 +1,67 @@
+/*
+Copyright 2023 Sangfor Technologies Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package kernel
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	"arsenal-os/submodules"
+	"arsenal-os/util"
+)
+
+func init() {
+	// 块设备IO请求失败故障，只对make-it-fail为1的块设备生效。
+	var newFaultType = failMakeRequest{
+		faultInjection: faultInjection{
+			FaultType: "kernel-fail-make-request",
+			name:      "fail_make_request",
+			config:    "CONFIG_FAIL_MAKE_REQUEST",
+		},
+	}
+	submodules.Add(newFaultType.FaultType, &newFaultType)
+}
+
+const sysBlockPath = "/sys/class/block"
+
+type failMakeRequest struct {
+	faultInjection
+}
+
+func (f *failMakeRequest) Prepare(inputArgs []string) error {
+	if err := f.faultInjection.Prepare(inputArgs); err != nil {
+		return err
+	}
+	if inputArgs[submodules.OpsTypeIndex] == submodules.Remove {
+		return nil
+	}
+
+	deviceStr, ok := f.flags["device"]
+	if !ok {
+		return errors.New("please input param device, example: sda,sdb1")
+	}
+	for _, device := range strings.Split(deviceStr, ",") {
+		path := filepath.Join(sysBlockPath, filepath.Base(device), makeItFailFile)
+		if !util.FileIsExist(path) {
+			return fmt.Errorf("can't found %s, please input valid block device", path)
+		}
+		f.makeItFailPaths = append(f.makeItFailPaths, path)
+	}
+	return nil
+}
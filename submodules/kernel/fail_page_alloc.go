@@ -0,0 +1,31 @@
+/*
+Copyright 2023 Sangfor Technologies Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package kernel
+
+import "arsenal-os/submodules"
+
+func init() {
+	// 内存页分配失败故障，如：alloc_pages返回NULL。
+	var newFaultType = faultInjection{
+		FaultType:  "kernel-fail-page-alloc",
+		name:       "fail_page_alloc",
+		config:     "CONFIG_FAIL_PAGE_ALLOC",
+		boolKnobs:  []string{"ignore-gfp-wait", "ignore-gfp-highmem"},
+		valueKnobs: []string{"min-order"},
+	}
+	submodules.Add(newFaultType.FaultType, &newFaultType)
+}
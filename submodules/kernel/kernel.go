@@ -0,0 +1,286 @@
+/*
+Copyright 2023 Sangfor Technologies Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package kernel
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"arsenal-os/internal/parse"
+	"arsenal-os/submodules"
+	"arsenal-os/util"
+)
+
+// 内核故障注入框架通过debugfs下的属性文件控制，故障对整个系统生效，
+// 开启task-filter后只对/proc/<pid>/make-it-fail为1的进程生效。
+
+const (
+	debugfsPath = "/sys/kernel/debug"
+	// makeItFailFile 进程和块设备下控制是否参与故障注入的文件。
+	makeItFailFile = "make-it-fail"
+)
+
+type knobValue struct {
+	name  string
+	value string
+}
+
+// faultInjection 各类内核故障注入的通用实现，属性文件位于debugfs下名称为name的目录中。
+type faultInjection struct {
+	FaultType string
+	// name debugfs下的目录名，如：failslab。
+	name string
+	// config 该故障依赖的内核编译选项，用于提示不支持的原因。
+	config string
+	// boolKnobs和valueKnobs 该故障特有的属性，参数名与属性文件名相同。
+	boolKnobs  []string
+	valueKnobs []string
+
+	flags           map[string]string
+	knobs           []knobValue
+	makeItFailPaths []string
+}
+
+// faultInjectionBackup 记录注入前所有被修改的属性，清理时恢复。
+type faultInjectionBackup struct {
+	Knobs      map[string]string
+	MakeItFail map[string]string
+}
+
+func (f *faultInjection) dir() string {
+	return filepath.Join(debugfsPath, f.name)
+}
+
+func readKnob(path string) (string, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", fmt.Errorf("read %s failed: %v", path, err)
+	}
+	return strings.TrimSpace(string(data)), nil
+}
+
+func writeKnob(path, value string) error {
+	if err := ioutil.WriteFile(path, []byte(value), 0); err != nil {
+		return fmt.Errorf("write %s to %s failed: %v", value, path, err)
+	}
+	return nil
+}
+
+// supportCheck 检查debugfs是否挂载以及内核是否支持该故障。
+func (f *faultInjection) supportCheck() error {
+	if util.FileIsExist(f.dir()) {
+		return nil
+	}
+	mounts, err := ioutil.ReadFile("/proc/mounts")
+	if err == nil && !strings.Contains(string(mounts), " "+debugfsPath+" debugfs ") {
+		return fmt.Errorf("debugfs is not mounted, please mount it by: mount -t debugfs none %s", debugfsPath)
+	}
+	return fmt.Errorf("can't found %s, kernel is not built with %s and CONFIG_FAULT_INJECTION_DEBUG_FS",
+		f.dir(), f.config)
+}
+
+// intKnobParser 解析整数类型的属性参数，参数不存在时使用defaultValue，defaultValue为空时不修改该属性。
+func (f *faultInjection) intKnobParser(name, defaultValue string, min int) error {
+	value, ok := f.flags[name]
+	if !ok {
+		value = defaultValue
+	}
+	if value == "" {
+		return nil
+	}
+	number, err := strconv.Atoi(value)
+	if err != nil || number < min {
+		return fmt.Errorf("%s param(%s) must be an integer not less than %d", name, value, min)
+	}
+	f.knobs = append(f.knobs, knobValue{name: name, value: value})
+	return nil
+}
+
+func (f *faultInjection) boolKnobParser(name string) error {
+	if _, ok := f.flags[name]; !ok {
+		return nil
+	}
+	value, err := parse.GetBoolFlag(f.flags, name)
+	if err != nil {
+		return err
+	}
+	knob := knobValue{name: name, value: "N"}
+	if value {
+		knob.value = "Y"
+	}
+	f.knobs = append(f.knobs, knob)
+	return nil
+}
+
+// knobsParser 解析属性参数，probability放在最后写入，保证其他属性生效后才开始注入故障。
+func (f *faultInjection) knobsParser() error {
+	probability, ok := f.flags["probability"]
+	if !ok {
+		return errors.New("please input param probability")
+	}
+	if number, err := strconv.Atoi(probability); err != nil || number <= 0 || number > 100 {
+		return fmt.Errorf("probability param(%s) must be an integer in range [1, 100]", probability)
+	}
+
+	if err := f.intKnobParser("interval", "", 1); err != nil {
+		return err
+	}
+	// times默认值为1，只会注入一次故障，未指定时改为不限次数。
+	if err := f.intKnobParser("times", "-1", -1); err != nil {
+		return err
+	}
+	if err := f.intKnobParser("verbose", "", 0); err != nil {
+		return err
+	}
+	if spaceStr, ok := f.flags["space"]; ok {
+		space, err := util.ParseSize(spaceStr)
+		if err != nil {
+			return fmt.Errorf("space param error: %v", err)
+		}
+		f.knobs = append(f.knobs, knobValue{name: "space", value: strconv.FormatUint(space, 10)})
+	}
+	for _, name := range f.boolKnobs {
+		if err := f.boolKnobParser(name); err != nil {
+			return err
+		}
+	}
+	for _, name := range f.valueKnobs {
+		if value, ok := f.flags[name]; ok {
+			f.knobs = append(f.knobs, knobValue{name: name, value: value})
+		}
+	}
+	f.knobs = append(f.knobs, knobValue{name: "probability", value: probability})
+	return nil
+}
+
+// targetParser 指定目标进程时开启task-filter，并设置目标进程所有线程的make-it-fail。
+func (f *faultInjection) targetParser() error {
+	if !util.IsTargetSpecified(f.flags) {
+		f.knobs = append(f.knobs, knobValue{name: "task-filter", value: "N"})
+		return nil
+	}
+	pids, err := util.GetTargetProcesses(f.flags)
+	if err != nil {
+		return err
+	}
+	for _, pid := range pids {
+		tids, err := util.GetProcessThreadIDs(pid)
+		if err != nil {
+			return err
+		}
+		for _, tid := range tids {
+			path := fmt.Sprintf("/proc/%d/task/%d/%s", pid, tid, makeItFailFile)
+			if !util.FileIsExist(path) {
+				return fmt.Errorf("can't found %s, kernel is not built with CONFIG_FAULT_INJECTION", path)
+			}
+			f.makeItFailPaths = append(f.makeItFailPaths, path)
+		}
+	}
+	f.knobs = append(f.knobs, knobValue{name: "task-filter", value: "Y"})
+	return nil
+}
+
+func (f *faultInjection) Prepare(inputArgs []string) error {
+	f.flags = parse.TransInputFlagsToMap(inputArgs)
+	if err := f.supportCheck(); err != nil {
+		return err
+	}
+	if inputArgs[submodules.OpsTypeIndex] == submodules.Remove {
+		return nil
+	}
+
+	f.knobs = nil
+	f.makeItFailPaths = nil
+	if err := f.targetParser(); err != nil {
+		return err
+	}
+	return f.knobsParser()
+}
+
+func (f *faultInjection) FaultInject(_ []string) error {
+	if util.StateIsExist(f.FaultType) {
+		return fmt.Errorf("%s fault has been injected", f.FaultType)
+	}
+
+	backup := faultInjectionBackup{Knobs: make(map[string]string), MakeItFail: make(map[string]string)}
+	for _, knob := range f.knobs {
+		value, err := readKnob(filepath.Join(f.dir(), knob.name))
+		if err != nil {
+			return err
+		}
+		backup.Knobs[knob.name] = value
+	}
+	for _, path := range f.makeItFailPaths {
+		value, err := readKnob(path)
+		if err != nil {
+			return err
+		}
+		backup.MakeItFail[path] = value
+	}
+	if err := util.SaveState(f.FaultType, &backup); err != nil {
+		return err
+	}
+
+	// 先设置目标再开启故障，probability位于最后。
+	for _, path := range f.makeItFailPaths {
+		if err := writeKnob(path, "1"); err != nil {
+			return err
+		}
+	}
+	for _, knob := range f.knobs {
+		if err := writeKnob(filepath.Join(f.dir(), knob.name), knob.value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (f *faultInjection) FaultRemove(_ []string) error {
+	if !util.StateIsExist(f.FaultType) {
+		return nil
+	}
+	var backup faultInjectionBackup
+	if err := util.LoadState(f.FaultType, &backup); err != nil {
+		return err
+	}
+
+	// 先恢复probability停止注入故障。
+	if value, ok := backup.Knobs["probability"]; ok {
+		if err := writeKnob(filepath.Join(f.dir(), "probability"), value); err != nil {
+			return err
+		}
+	}
+	for name, value := range backup.Knobs {
+		if err := writeKnob(filepath.Join(f.dir(), name), value); err != nil {
+			return err
+		}
+	}
+	for path, value := range backup.MakeItFail {
+		// 目标线程可能已经退出。
+		if !util.FileIsExist(path) {
+			continue
+		}
+		if err := writeKnob(path, value); err != nil {
+			return err
+		}
+	}
+	return util.RemoveState(f.FaultType)
+}
@@ -0,0 +1,274 @@
+/*
+Copyright 2023 Sangfor Technologies Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package memory
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+
+	"arsenal-os/internal/parse"
+	"arsenal-os/submodules"
+	"arsenal-os/util"
+
+	"golang.org/x/sys/unix"
+)
+
+func init() {
+	var newFaultType = fragmentation{
+		FaultType: "memory-fragmentation",
+	}
+	submodules.Add(newFaultType.FaultType, &newFaultType)
+}
+
+const (
+	buddyInfoPath                = "/proc/buddyinfo"
+	compactionProactivenessPath  = "/proc/sys/vm/compaction_proactiveness"
+	fragmentationChunkSize       = 64 << 20
+	fragmentationMaxOrder        = 10
+	fragmentationDefaultMinOrder = 1
+)
+
+type fragmentation struct {
+	FaultType         string
+	flags             map[string]string
+	order             int
+	maxSize           uint64
+	disableCompaction bool
+}
+
+// compactionBackup 记录注入前主动内存规整的配置。
+type compactionBackup struct {
+	Proactiveness string
+}
+
+// highOrderFreeBlocks 统计/proc/buddyinfo中阶数不小于order的空闲块数量。用户态内存优先从Normal和Movable zone分配，
+// DMA和DMA32 zone有lowmem保留几乎不会被耗尽，只在没有Normal和Movable zone时统计DMA32 zone。
+func highOrderFreeBlocks(order int) (uint64, error) {
+	file, err := os.Open(buddyInfoPath)
+	if err != nil {
+		return 0, fmt.Errorf("open %s failed: %v", buddyInfoPath, err)
+	}
+	defer file.Close()
+
+	zoneBlocks := make(map[string]uint64)
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		// 行格式为：Node 0, zone   Normal   1163   772   ...，zone名之后依次为0阶到最高阶的空闲块数量。
+		fields := strings.Fields(scanner.Text())
+		const zoneNameIndex, countStartIndex = 3, 4
+		if len(fields) <= countStartIndex {
+			continue
+		}
+		for index, countStr := range fields[countStartIndex:] {
+			if index < order {
+				continue
+			}
+			count, err := strconv.ParseUint(countStr, 10, 64)
+			if err != nil {
+				return 0, fmt.Errorf("parse %s failed: %v", buddyInfoPath, err)
+			}
+			zoneBlocks[fields[zoneNameIndex]] += count
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return 0, fmt.Errorf("read %s failed: %v", buddyInfoPath, err)
+	}
+
+	normalBlocks, hasNormal := zoneBlocks["Normal"]
+	movableBlocks, hasMovable := zoneBlocks["Movable"]
+	if hasNormal || hasMovable {
+		return normalBlocks + movableBlocks, nil
+	}
+	return zoneBlocks["DMA32"], nil
+}
+
+func (f *fragmentation) Prepare(inputArgs []string) error {
+	f.flags = parse.TransInputFlagsToMap(inputArgs)
+	if !util.FileIsExist(buddyInfoPath) {
+		return fmt.Errorf("can't found %s", buddyInfoPath)
+	}
+	if inputArgs[submodules.OpsTypeIndex] == submodules.Remove {
+		return nil
+	}
+
+	f.order = fragmentationDefaultMinOrder
+	if orderStr, ok := f.flags["order"]; ok {
+		order, err := strconv.Atoi(orderStr)
+		if err != nil || order < 1 || order > fragmentationMaxOrder {
+			return fmt.Errorf("order param(%s) must be in range [1, %d]", orderStr, fragmentationMaxOrder)
+		}
+		f.order = order
+	}
+
+	// 碎片化过程中占用一半申请的内存，限制最大申请量避免触发OOM killer。
+	available, err := util.GetMemInfoItem("MemAvailable")
+	if err != nil {
+		return err
+	}
+	f.maxSize = available / 10 * 9
+	if maxSizeStr, ok := f.flags["max-size"]; ok {
+		maxSize, err := util.ParseSize(maxSizeStr)
+		if err != nil {
+			return fmt.Errorf("max-size param error: %v", err)
+		}
+		if maxSize > f.maxSize {
+			return fmt.Errorf("max-size(%s) is larger than 90%% of available memory(%s)",
+				maxSizeStr, util.FormatSize(available))
+		}
+		f.maxSize = maxSize
+	}
+
+	disableCompaction, err := parse.GetBoolFlag(f.flags, "disable-compaction")
+	if err != nil {
+		return err
+	}
+	if disableCompaction && !util.FileIsExist(compactionProactivenessPath) {
+		return fmt.Errorf("can't found %s, proactive compaction is not supported", compactionProactivenessPath)
+	}
+	f.disableCompaction = disableCompaction
+	return nil
+}
+
+// disableProactiveCompaction 保存原始配置后关闭主动内存规整，避免kcompactd将碎片重新规整。
+func (f *fragmentation) disableProactiveCompaction() error {
+	data, err := ioutil.ReadFile(compactionProactivenessPath)
+	if err != nil {
+		return fmt.Errorf("read %s failed: %v", compactionProactivenessPath, err)
+	}
+	backup := compactionBackup{Proactiveness: strings.TrimSpace(string(data))}
+	if err := util.SaveState(f.FaultType, &backup); err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(compactionProactivenessPath, []byte("0"), 0); err != nil {
+		return fmt.Errorf("write 0 to %s failed: %v", compactionProactivenessPath, err)
+	}
+	return nil
+}
+
+// allocChunk 申请一块匿名内存并逐页写入，保证分配物理内存。
+func allocChunk() ([]byte, error) {
+	chunk, err := unix.Mmap(-1, 0, fragmentationChunkSize, unix.PROT_READ|unix.PROT_WRITE,
+		unix.MAP_PRIVATE|unix.MAP_ANONYMOUS)
+	if err != nil {
+		return nil, fmt.Errorf("mmap anonymous memory failed: %v", err)
+	}
+	// 透明大页会使整块内存以2M为单位分配，隔页释放时只会拆分大页而不会产生碎片。
+	if err := unix.Madvise(chunk, unix.MADV_NOHUGEPAGE); err != nil {
+		unix.Munmap(chunk)
+		return nil, fmt.Errorf("madvise MADV_NOHUGEPAGE failed: %v", err)
+	}
+
+	pageSize := unix.Getpagesize()
+	for offset := 0; offset < len(chunk); offset += pageSize {
+		chunk[offset] = 1
+	}
+	return chunk, nil
+}
+
+// punchHoles 隔页释放内存块，使释放的页无法与相邻页合并成高阶空闲块。
+func punchHoles(chunk []byte) error {
+	pageSize := unix.Getpagesize()
+	for offset := 0; offset < len(chunk); offset += 2 * pageSize {
+		if err := unix.Madvise(chunk[offset:offset+pageSize], unix.MADV_DONTNEED); err != nil {
+			return fmt.Errorf("madvise MADV_DONTNEED failed: %v", err)
+		}
+	}
+	return nil
+}
+
+func (f *fragmentation) FaultInject(_ []string) error {
+	if util.StateIsExist(f.FaultType) || util.KeeperIsRunning(f.FaultType) {
+		return fmt.Errorf("%s fault has been injected", f.FaultType)
+	}
+	if f.disableCompaction {
+		if err := f.disableProactiveCompaction(); err != nil {
+			return err
+		}
+	}
+
+	stopChan, err := util.StartKeeper(f.FaultType)
+	if err != nil {
+		return err
+	}
+	defer util.FinishKeeper(f.FaultType)
+
+	var chunks [][]byte
+	defer func() {
+		for _, chunk := range chunks {
+			unix.Munmap(chunk)
+		}
+	}()
+	// 先申请全部内存块直到高阶空闲块耗尽，再统一隔页释放，避免释放的页被后续内存块的缺页重新占用。
+	for allocated := uint64(0); allocated+fragmentationChunkSize <= f.maxSize; allocated += fragmentationChunkSize {
+		blocks, err := highOrderFreeBlocks(f.order)
+		if err != nil {
+			return err
+		}
+		if blocks == 0 {
+			break
+		}
+
+		chunk, err := allocChunk()
+		if err != nil {
+			return err
+		}
+		chunks = append(chunks, chunk)
+		select {
+		case <-stopChan:
+			return nil
+		default:
+		}
+	}
+	for _, chunk := range chunks {
+		if err := punchHoles(chunk); err != nil {
+			return err
+		}
+	}
+
+	// 达到max-size时保持已产生的碎片，由用户决定是否清理。
+	blocks, err := highOrderFreeBlocks(f.order)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("allocated %s, free blocks of order >= %d: %d\n",
+		util.FormatSize(uint64(len(chunks))*fragmentationChunkSize), f.order, blocks)
+
+	<-stopChan
+	return nil
+}
+
+func (f *fragmentation) FaultRemove(_ []string) error {
+	if err := util.StopKeeper(f.FaultType); err != nil {
+		return fmt.Errorf("remove %s failed: %v", f.FaultType, err)
+	}
+
+	if !util.StateIsExist(f.FaultType) {
+		return nil
+	}
+	var backup compactionBackup
+	if err := util.LoadState(f.FaultType, &backup); err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(compactionProactivenessPath, []byte(backup.Proactiveness), 0); err != nil {
+		return fmt.Errorf("write %s to %s failed: %v", backup.Proactiveness, compactionProactivenessPath, err)
+	}
+	return util.RemoveState(f.FaultType)
+}
@@ -0,0 +1,293 @@
+/*
+Copyright 2023 Sangfor Technologies Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package memory
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/bits"
+	"sort"
+	"strconv"
+	"strings"
+
+	"arsenal-os/internal/parse"
+	"arsenal-os/submodules"
+	"arsenal-os/util"
+
+	"golang.org/x/sys/unix"
+)
+
+func init() {
+	var newFaultType = hugepageExhaustion{
+		FaultType: "memory-hugepage-exhaustion",
+	}
+	submodules.Add(newFaultType.FaultType, &newFaultType)
+}
+
+const hugepagesSysfsDir = "/sys/kernel/mm/hugepages"
+
+var validHugepageModes = []string{"consume", "shrink", "both"}
+
+type hugepageExhaustion struct {
+	FaultType   string
+	flags       map[string]string
+	mode        string
+	pageSize    uint64
+	count       uint64
+	nrHugepages uint64
+}
+
+// hugepagePoolBackup 记录注入前大页池的配置。
+type hugepagePoolBackup struct {
+	PageSize    uint64
+	NrHugepages string
+}
+
+func hugepageSizeDir(pageSize uint64) string {
+	return fmt.Sprintf("%s/hugepages-%dkB", hugepagesSysfsDir, pageSize>>10)
+}
+
+func readHugepageItem(pageSize uint64, item string) (uint64, error) {
+	path := fmt.Sprintf("%s/%s", hugepageSizeDir(pageSize), item)
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return 0, fmt.Errorf("read %s failed: %v", path, err)
+	}
+	value, err := strconv.ParseUint(strings.TrimSpace(string(data)), 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("trans %s value to int failed: %v", path, err)
+	}
+	return value, nil
+}
+
+func writeHugepageItem(pageSize uint64, item, value string) error {
+	path := fmt.Sprintf("%s/%s", hugepageSizeDir(pageSize), item)
+	if err := ioutil.WriteFile(path, []byte(value), 0); err != nil {
+		return fmt.Errorf("write %s to %s failed: %v", value, path, err)
+	}
+	return nil
+}
+
+// availableHugepages 返回未被使用和预留的大页数量。
+func availableHugepages(pageSize uint64) (uint64, error) {
+	free, err := readHugepageItem(pageSize, "free_hugepages")
+	if err != nil {
+		return 0, err
+	}
+	resv, err := readHugepageItem(pageSize, "resv_hugepages")
+	if err != nil {
+		return 0, err
+	}
+	if resv > free {
+		return 0, nil
+	}
+	return free - resv, nil
+}
+
+func (h *hugepageExhaustion) pageSizeParser() error {
+	if pageSizeStr, ok := h.flags["page-size"]; ok {
+		pageSize, err := util.ParseSize(pageSizeStr)
+		if err != nil {
+			return fmt.Errorf("page-size param error: %v", err)
+		}
+		h.pageSize = pageSize
+	} else {
+		// 未指定时使用系统默认的大页大小。
+		pageSize, err := util.GetMemInfoItem("Hugepagesize")
+		if err != nil {
+			return err
+		}
+		h.pageSize = pageSize
+	}
+
+	if !util.FileIsExist(hugepageSizeDir(h.pageSize)) {
+		return fmt.Errorf("unsupported hugepage size: %s", util.FormatSize(h.pageSize))
+	}
+	return nil
+}
+
+func (h *hugepageExhaustion) modeParser() error {
+	h.mode = "consume"
+	if mode, ok := h.flags["mode"]; ok {
+		h.mode = mode
+	}
+	if !util.IsValidValue(h.mode, validHugepageModes) {
+		return fmt.Errorf("invalid mode %s, example: %s", h.mode, validHugepageModes)
+	}
+
+	if h.mode != "consume" {
+		nrStr, ok := h.flags["nr-hugepages"]
+		if !ok {
+			return errors.New("please input param nr-hugepages")
+		}
+		nrHugepages, err := strconv.ParseUint(nrStr, 10, 64)
+		if err != nil {
+			return fmt.Errorf("trans nr-hugepages(%s) to int failed: %v", nrStr, err)
+		}
+		h.nrHugepages = nrHugepages
+	}
+	if countStr, ok := h.flags["count"]; ok {
+		count, err := strconv.ParseUint(countStr, 10, 64)
+		if err != nil || count == 0 {
+			return fmt.Errorf("count param(%s) must be a positive integer", countStr)
+		}
+		h.count = count
+	}
+	return nil
+}
+
+func (h *hugepageExhaustion) Prepare(inputArgs []string) error {
+	h.flags = parse.TransInputFlagsToMap(inputArgs)
+	if !util.FileIsExist(hugepagesSysfsDir) {
+		return fmt.Errorf("can't found %s, hugepage is not supported", hugepagesSysfsDir)
+	}
+	opsType := inputArgs[submodules.OpsTypeIndex]
+	if opsType == submodules.Remove || opsType == submodules.Status {
+		return nil
+	}
+
+	if err := h.pageSizeParser(); err != nil {
+		return err
+	}
+	return h.modeParser()
+}
+
+// shrinkPool 保存大页池原始配置后缩小nr_hugepages。
+func (h *hugepageExhaustion) shrinkPool() error {
+	nrHugepages, err := readHugepageItem(h.pageSize, "nr_hugepages")
+	if err != nil {
+		return err
+	}
+	if h.nrHugepages >= nrHugepages {
+		return fmt.Errorf("nr-hugepages(%d) must be less than current value(%d)", h.nrHugepages, nrHugepages)
+	}
+
+	backup := hugepagePoolBackup{PageSize: h.pageSize, NrHugepages: strconv.FormatUint(nrHugepages, 10)}
+	if err := util.SaveState(h.FaultType, &backup); err != nil {
+		return err
+	}
+	return writeHugepageItem(h.pageSize, "nr_hugepages", strconv.FormatUint(h.nrHugepages, 10))
+}
+
+// consumePool 通过MAP_HUGETLB申请并写入大页，直到收到停止信号。
+func (h *hugepageExhaustion) consumePool() error {
+	available, err := availableHugepages(h.pageSize)
+	if err != nil {
+		return err
+	}
+	count := available
+	if h.count != 0 {
+		if h.count > available {
+			return fmt.Errorf("only %d hugepages are available, less than %d", available, h.count)
+		}
+		count = h.count
+	}
+	if count == 0 {
+		return fmt.Errorf("no free %s hugepage to consume", util.FormatSize(h.pageSize))
+	}
+
+	stopChan, err := util.StartKeeper(h.FaultType)
+	if err != nil {
+		return err
+	}
+	defer util.FinishKeeper(h.FaultType)
+
+	// MAP_HUGE_SHIFT编码的是大页大小以2为底的对数。
+	hugeFlag := (bits.Len64(h.pageSize) - 1) << unix.MAP_HUGE_SHIFT
+	memory, err := unix.Mmap(-1, 0, int(count*h.pageSize), unix.PROT_READ|unix.PROT_WRITE,
+		unix.MAP_PRIVATE|unix.MAP_ANONYMOUS|unix.MAP_HUGETLB|hugeFlag)
+	if err != nil {
+		return fmt.Errorf("mmap %d %s hugepages failed: %v", count, util.FormatSize(h.pageSize), err)
+	}
+	defer unix.Munmap(memory)
+	for offset := uint64(0); offset < uint64(len(memory)); offset += h.pageSize {
+		memory[offset] = 1
+	}
+	fmt.Printf("consumed %d %s hugepages\n", count, util.FormatSize(h.pageSize))
+
+	<-stopChan
+	return nil
+}
+
+func (h *hugepageExhaustion) FaultInject(_ []string) error {
+	if util.StateIsExist(h.FaultType) || util.KeeperIsRunning(h.FaultType) {
+		return fmt.Errorf("%s fault has been injected", h.FaultType)
+	}
+
+	if h.mode != "consume" {
+		if err := h.shrinkPool(); err != nil {
+			return fmt.Errorf("shrink hugepage pool failed: %v", err)
+		}
+	}
+	if h.mode != "shrink" {
+		return h.consumePool()
+	}
+	return nil
+}
+
+func (h *hugepageExhaustion) FaultRemove(_ []string) error {
+	if err := util.StopKeeper(h.FaultType); err != nil {
+		return fmt.Errorf("remove %s failed: %v", h.FaultType, err)
+	}
+
+	if !util.StateIsExist(h.FaultType) {
+		return nil
+	}
+	var backup hugepagePoolBackup
+	if err := util.LoadState(h.FaultType, &backup); err != nil {
+		return err
+	}
+	if err := writeHugepageItem(backup.PageSize, "nr_hugepages", backup.NrHugepages); err != nil {
+		return err
+	}
+	return util.RemoveState(h.FaultType)
+}
+
+// FaultStatus 输出各大页大小的空闲和总数量。
+func (h *hugepageExhaustion) FaultStatus(_ []string) error {
+	dirList, err := ioutil.ReadDir(hugepagesSysfsDir)
+	if err != nil {
+		return fmt.Errorf("read %s failed: %v", hugepagesSysfsDir, err)
+	}
+
+	var pageSizes []uint64
+	for _, dir := range dirList {
+		// 目录名格式为：hugepages-2048kB。
+		sizeStr := strings.TrimSuffix(strings.TrimPrefix(dir.Name(), "hugepages-"), "kB")
+		sizeKB, err := strconv.ParseUint(sizeStr, 10, 64)
+		if err != nil {
+			continue
+		}
+		pageSizes = append(pageSizes, sizeKB<<10)
+	}
+	sort.Slice(pageSizes, func(i, j int) bool { return pageSizes[i] < pageSizes[j] })
+
+	fmt.Printf("%-10s%10s%10s%10s\n", "SIZE", "FREE", "RESV", "TOTAL")
+	for _, pageSize := range pageSizes {
+		var values []uint64
+		for _, item := range []string{"free_hugepages", "resv_hugepages", "nr_hugepages"} {
+			value, err := readHugepageItem(pageSize, item)
+			if err != nil {
+				return err
+			}
+			values = append(values, value)
+		}
+		fmt.Printf("%-10s%10d%10d%10d\n", util.FormatSize(pageSize), values[0], values[1], values[2])
+	}
+	return nil
+}
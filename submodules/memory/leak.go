@@ -0,0 +1,212 @@
+/*
+Copyright 2023 Sangfor Technologies Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package memory
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"arsenal-os/internal/parse"
+	"arsenal-os/submodules"
+	"arsenal-os/util"
+)
+
+func init() {
+	var newFaultType = leak{
+		FaultType: "memory-leak",
+	}
+	submodules.Add(newFaultType.FaultType, &newFaultType)
+}
+
+const (
+	// leakGrowInterval 内存泄漏的增长周期。
+	leakGrowInterval = time.Second
+	// leakChunkSize 每次泄漏的最小内存块，较小的块使内存曲线更平滑。
+	leakChunkSize = 1 << 20
+)
+
+var leakRatePeriods = map[string]time.Duration{
+	"s":    time.Second,
+	"sec":  time.Second,
+	"m":    time.Minute,
+	"min":  time.Minute,
+	"h":    time.Hour,
+	"hour": time.Hour,
+}
+
+type leak struct {
+	FaultType  string
+	flags      map[string]string
+	rate       uint64
+	period     time.Duration
+	ceiling    uint64
+	cgroupPath string
+}
+
+// leakStatus keeper周期性更新的泄漏进度，用于状态查询。
+type leakStatus struct {
+	LeakedBytes uint64
+	Ceiling     uint64
+	Rate        string
+	StartTime   time.Time
+}
+
+// rateParser 解析泄漏速率，格式为：容量/时间单位，如：50M/min。
+func (l *leak) rateParser() error {
+	rateStr, ok := l.flags["rate"]
+	if !ok {
+		return errors.New("please input param rate, example: 50M/min")
+	}
+	parts := strings.Split(rateStr, "/")
+	if len(parts) != 2 {
+		return fmt.Errorf("rate param(%s) format error, example: 50M/min", rateStr)
+	}
+
+	rate, err := util.ParseSize(parts[0])
+	if err != nil {
+		return fmt.Errorf("rate param(%s) error: %v", rateStr, err)
+	}
+	if rate == 0 {
+		return fmt.Errorf("rate param(%s) must be larger than 0", rateStr)
+	}
+	period, ok := leakRatePeriods[strings.ToLower(parts[1])]
+	if !ok {
+		return fmt.Errorf("unsupported rate time unit: %s", parts[1])
+	}
+	l.rate = rate
+	l.period = period
+	return nil
+}
+
+func (l *leak) Prepare(inputArgs []string) error {
+	l.flags = parse.TransInputFlagsToMap(inputArgs)
+	opsType := inputArgs[submodules.OpsTypeIndex]
+	if opsType == submodules.Remove || opsType == submodules.Status {
+		return nil
+	}
+
+	if err := l.rateParser(); err != nil {
+		return err
+	}
+
+	ceilingStr, ok := l.flags["ceiling"]
+	if !ok {
+		return errors.New("please input param ceiling")
+	}
+	ceiling, err := util.ParseSize(ceilingStr)
+	if err != nil {
+		return fmt.Errorf("ceiling param error: %v", err)
+	}
+	memTotal, err := util.GetMemInfoItem("MemTotal")
+	if err != nil {
+		return err
+	}
+	if ceiling == 0 || ceiling > memTotal {
+		return fmt.Errorf("ceiling(%s) must be in range (0, %s]", ceilingStr, util.FormatSize(memTotal))
+	}
+	l.ceiling = ceiling
+
+	if cgroupPath, ok := l.flags["cgroup"]; ok {
+		fullPath, err := util.GetCgroupFullPath(cgroupPath, "memory")
+		if err != nil {
+			return fmt.Errorf("cgroup param error: %v", err)
+		}
+		l.cgroupPath = fullPath
+	}
+	return nil
+}
+
+// expectedLeakedBytes 按泄漏速率计算从开始到当前应泄漏的内存大小。
+func (l *leak) expectedLeakedBytes(elapsed time.Duration) uint64 {
+	expected := uint64(float64(l.rate) * elapsed.Seconds() / l.period.Seconds())
+	if expected > l.ceiling {
+		return l.ceiling
+	}
+	return expected
+}
+
+func (l *leak) FaultInject(_ []string) error {
+	stopChan, err := util.StartKeeper(l.FaultType)
+	if err != nil {
+		return err
+	}
+	defer util.FinishKeeper(l.FaultType)
+
+	// 泄漏的内存计入目标cgroup，用于验证容器内存告警和重启策略。
+	if l.cgroupPath != "" {
+		if err := util.MoveProcessToCgroup(os.Getpid(), l.cgroupPath); err != nil {
+			return err
+		}
+	}
+
+	memory := util.AnonMemory{ChunkSize: leakChunkSize}
+	defer memory.Release()
+	status := leakStatus{
+		Ceiling:   l.ceiling,
+		Rate:      l.flags["rate"],
+		StartTime: time.Now(),
+	}
+	if err := util.SaveState(l.FaultType, &status); err != nil {
+		return err
+	}
+	ticker := time.NewTicker(leakGrowInterval)
+	defer ticker.Stop()
+	for {
+		expected := l.expectedLeakedBytes(time.Since(status.StartTime))
+		if expected >= memory.Size()+leakChunkSize {
+			if err := memory.Grow((expected - memory.Size()) / leakChunkSize * leakChunkSize); err != nil {
+				fmt.Printf("%s grow memory failed: %v\n", l.FaultType, err)
+			}
+			status.LeakedBytes = memory.Size()
+			if err := util.SaveState(l.FaultType, &status); err != nil {
+				fmt.Printf("%s save status failed: %v\n", l.FaultType, err)
+			}
+		}
+
+		select {
+		case <-stopChan:
+			return util.RemoveState(l.FaultType)
+		case <-ticker.C:
+		}
+	}
+}
+
+func (l *leak) FaultRemove(_ []string) error {
+	if err := util.StopKeeper(l.FaultType); err != nil {
+		return fmt.Errorf("remove %s failed: %v", l.FaultType, err)
+	}
+	return util.RemoveState(l.FaultType)
+}
+
+// FaultStatus 输出当前已泄漏的内存大小。
+func (l *leak) FaultStatus(_ []string) error {
+	if !util.KeeperIsRunning(l.FaultType) {
+		return fmt.Errorf("%s fault is not running", l.FaultType)
+	}
+
+	var status leakStatus
+	if err := util.LoadState(l.FaultType, &status); err != nil {
+		return err
+	}
+	fmt.Printf("leaked: %d bytes(%s), ceiling: %s, rate: %s, elapsed: %s\n",
+		status.LeakedBytes, util.FormatSize(status.LeakedBytes), util.FormatSize(status.Ceiling),
+		status.Rate, time.Since(status.StartTime).Truncate(time.Second))
+	return nil
+}
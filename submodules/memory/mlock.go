@@ -0,0 +1,134 @@
+/*
+Copyright 2023 Sangfor Technologies Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package memory
+
+import (
+	"errors"
+	"fmt"
+
+	"arsenal-os/internal/parse"
+	"arsenal-os/submodules"
+	"arsenal-os/util"
+
+	"golang.org/x/sys/unix"
+)
+
+func init() {
+	var newFaultType = mlock{
+		FaultType: "memory-mlock",
+	}
+	submodules.Add(newFaultType.FaultType, &newFaultType)
+}
+
+// mlockChunkSize 锁定内存时每个内存块的大小。
+const mlockChunkSize = 1 << 20
+
+type mlock struct {
+	FaultType string
+	flags     map[string]string
+	size      uint64
+}
+
+// memlockLimitCheck 检查RLIMIT_MEMLOCK是否满足锁定size字节内存，不满足时尝试提高当前进程的限制。
+func (m *mlock) memlockLimitCheck() error {
+	var rlimit unix.Rlimit
+	if err := unix.Getrlimit(unix.RLIMIT_MEMLOCK, &rlimit); err != nil {
+		return fmt.Errorf("get RLIMIT_MEMLOCK failed: %v", err)
+	}
+	// 具有CAP_IPC_LOCK权限的进程锁定内存不受RLIMIT_MEMLOCK限制。
+	if rlimit.Cur == unix.RLIM_INFINITY || rlimit.Cur >= m.size || util.HasCapability(unix.CAP_IPC_LOCK) {
+		return nil
+	}
+
+	// 提高硬限制需要CAP_SYS_RESOURCE权限。
+	newLimit := unix.Rlimit{Cur: m.size, Max: rlimit.Max}
+	if rlimit.Max != unix.RLIM_INFINITY && rlimit.Max < m.size {
+		newLimit.Max = m.size
+	}
+	if err := unix.Setrlimit(unix.RLIMIT_MEMLOCK, &newLimit); err != nil {
+		return fmt.Errorf("RLIMIT_MEMLOCK(%s) is less than %s and raise it failed: %v",
+			util.FormatSize(rlimit.Cur), util.FormatSize(m.size), err)
+	}
+	return nil
+}
+
+func (m *mlock) Prepare(inputArgs []string) error {
+	m.flags = parse.TransInputFlagsToMap(inputArgs)
+	if inputArgs[submodules.OpsTypeIndex] == submodules.Remove {
+		return nil
+	}
+
+	sizeStr, ok := m.flags["size"]
+	if !ok {
+		return errors.New("please input param size")
+	}
+	size, err := util.ParseSize(sizeStr)
+	if err != nil {
+		return fmt.Errorf("size param error: %v", err)
+	}
+	if size == 0 {
+		return errors.New("size must be larger than 0")
+	}
+	// mlock以页为单位锁定内存，按页向上取整。
+	pageSize := uint64(unix.Getpagesize())
+	m.size = (size + pageSize - 1) / pageSize * pageSize
+
+	// 锁定的内存无法被回收，超过可用内存时会直接触发OOM killer。
+	available, err := util.GetMemInfoItem("MemAvailable")
+	if err != nil {
+		return err
+	}
+	if m.size > available {
+		return fmt.Errorf("size(%s) is larger than available memory(%s)",
+			util.FormatSize(m.size), util.FormatSize(available))
+	}
+	return m.memlockLimitCheck()
+}
+
+func (m *mlock) FaultInject(_ []string) error {
+	stopChan, err := util.StartKeeper(m.FaultType)
+	if err != nil {
+		return err
+	}
+	defer util.FinishKeeper(m.FaultType)
+
+	// Grow按块向上取整，整块部分按1M分块锁定，不足1M的部分单独锁定，使实际锁定的内存与输入大小一致。
+	memory := util.AnonMemory{ChunkSize: mlockChunkSize, Locked: true}
+	defer memory.Release()
+	if err := memory.Grow(m.size / mlockChunkSize * mlockChunkSize); err != nil {
+		return fmt.Errorf("inject %s failed: %v", m.FaultType, err)
+	}
+	lockedSize := memory.Size()
+	if rest := m.size % mlockChunkSize; rest != 0 {
+		tail := util.AnonMemory{ChunkSize: rest, Locked: true}
+		defer tail.Release()
+		if err := tail.Grow(rest); err != nil {
+			return fmt.Errorf("inject %s failed: %v", m.FaultType, err)
+		}
+		lockedSize += tail.Size()
+	}
+	fmt.Printf("locked memory: %s\n", util.FormatSize(lockedSize))
+	<-stopChan
+	return nil
+}
+
+func (m *mlock) FaultRemove(_ []string) error {
+	if err := util.StopKeeper(m.FaultType); err != nil {
+		return fmt.Errorf("remove %s failed: %v", m.FaultType, err)
+	}
+	return nil
+}
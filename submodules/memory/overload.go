@@ -17,10 +17,15 @@ limitations under the License.
 package memory
 
 import (
+	"errors"
 	"fmt"
+	"strconv"
+	"time"
 
+	"arsenal-os/internal/parse"
 	"arsenal-os/pkg/tools"
 	"arsenal-os/submodules"
+	"arsenal-os/util"
 )
 
 func init() {
@@ -30,12 +35,73 @@ func init() {
 	submodules.Add(newFaultType.FaultType, &newFaultType)
 }
 
+const (
+	// overloadAdjustInterval keeper根据系统内存使用情况调整自身内存占用的周期。
+	overloadAdjustInterval = time.Second
+	// oomGuardMinReserve 未允许触发OOM时至少保留的可用内存。
+	oomGuardMinReserve = 128 << 20
+)
+
 type overload struct {
 	FaultType string
 	stressNg  tools.StressNg
+	flags     map[string]string
+	// isNative 通过--percent、--available-percent或--leave指定内存压力时，
+	// 不再使用stress-ng，由arsenal-os自身作为keeper占用内存。
+	isNative bool
+	percent  float64
+	leave    uint64
+	allowOOM bool
+}
+
+func parsePercent(flagName, percentStr string) (float64, error) {
+	percent, err := strconv.ParseFloat(percentStr, 64)
+	if err != nil || percent <= 0 || percent > 100 {
+		return 0, fmt.Errorf("%s param(%s) must be in range (0, 100]", flagName, percentStr)
+	}
+	return percent, nil
+}
+
+func (o *overload) nativeModeParser() error {
+	var flagNum int
+	for _, flagName := range []string{"percent", "available-percent", "leave"} {
+		if _, ok := o.flags[flagName]; ok {
+			flagNum++
+		}
+	}
+	if flagNum == 0 {
+		return nil
+	}
+	if flagNum > 1 {
+		return errors.New("only one of percent, available-percent and leave can be input")
+	}
+	o.isNative = true
+
+	var err error
+	if percentStr, ok := o.flags["percent"]; ok {
+		o.percent, err = parsePercent("percent", percentStr)
+	} else if percentStr, ok := o.flags["available-percent"]; ok {
+		o.percent, err = parsePercent("available-percent", percentStr)
+	} else {
+		o.leave, err = util.ParseSize(o.flags["leave"])
+	}
+	if err != nil {
+		return err
+	}
+
+	o.allowOOM, err = parse.GetBoolFlag(o.flags, "allow-oom")
+	return err
 }
 
 func (o *overload) Prepare(inputArgs []string) error {
+	o.flags = parse.TransInputFlagsToMap(inputArgs)
+	if err := o.nativeModeParser(); err != nil {
+		return fmt.Errorf("parser memory pressure param failed: %v", err)
+	}
+	if o.isNative {
+		return nil
+	}
+
 	// stress-ng添加持续消耗系统内存参数私有参数，
 	// --vm-keep 不做map和unmap操作，申请内存不释放，持续写内存。
 	// --vm-populate 先消耗普通内存，当普通内存不足时，消耗swap内存。
@@ -45,7 +111,82 @@ func (o *overload) Prepare(inputArgs []string) error {
 	return nil
 }
 
+// targetAvailable 根据输入参数计算系统需要维持的可用内存大小。
+func (o *overload) targetAvailable(memTotal, initialAvailable uint64) uint64 {
+	var target uint64
+	if _, ok := o.flags["percent"]; ok {
+		target = uint64(float64(memTotal) * (100 - o.percent) / 100)
+	} else if _, ok := o.flags["available-percent"]; ok {
+		target = uint64(float64(initialAvailable) * (100 - o.percent) / 100)
+	} else {
+		target = o.leave
+	}
+	if o.allowOOM {
+		return target
+	}
+
+	// 保留一定的可用内存，避免系统触发OOM killer。
+	guard := memTotal / 100
+	if guard < oomGuardMinReserve {
+		guard = oomGuardMinReserve
+	}
+	if target < guard {
+		target = guard
+	}
+	return target
+}
+
+// adjust 对比当前可用内存与目标值，按块增加或释放keeper占用的内存。
+func adjust(memory *util.AnonMemory, target uint64) error {
+	available, err := util.GetMemInfoItem("MemAvailable")
+	if err != nil {
+		return err
+	}
+
+	chunkSize := uint64(util.DefaultMemoryChunkSize)
+	if available > target+chunkSize {
+		return memory.Grow((available - target) / chunkSize * chunkSize)
+	}
+	if available+chunkSize < target {
+		return memory.Shrink(target - available)
+	}
+	return nil
+}
+
+func (o *overload) runKeeper() error {
+	memInfo, err := util.ReadMemInfo()
+	if err != nil {
+		return err
+	}
+	target := o.targetAvailable(memInfo["MemTotal"], memInfo["MemAvailable"])
+
+	stopChan, err := util.StartKeeper(o.FaultType)
+	if err != nil {
+		return err
+	}
+	defer util.FinishKeeper(o.FaultType)
+
+	var memory util.AnonMemory
+	defer memory.Release()
+	ticker := time.NewTicker(overloadAdjustInterval)
+	defer ticker.Stop()
+	for {
+		// 内存紧张时mmap可能失败，下一个周期重试。
+		if err := adjust(&memory, target); err != nil {
+			fmt.Printf("%s adjust memory failed: %v\n", o.FaultType, err)
+		}
+		select {
+		case <-stopChan:
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
+
 func (o *overload) FaultInject(_ []string) error {
+	if o.isNative {
+		return o.runKeeper()
+	}
 	if err := o.stressNg.Run(); err != nil {
 		return fmt.Errorf("inject %s failed: %v", o.FaultType, err)
 	}
@@ -53,6 +194,12 @@ func (o *overload) FaultInject(_ []string) error {
 }
 
 func (o *overload) FaultRemove(_ []string) error {
+	if o.isNative {
+		if err := util.StopKeeper(o.FaultType); err != nil {
+			return fmt.Errorf("remove %s failed: %v", o.FaultType, err)
+		}
+		return nil
+	}
 	if err := o.stressNg.Destroy(); err != nil {
 		return fmt.Errorf("remove %s failed: %v", o.FaultType, err)
 	}
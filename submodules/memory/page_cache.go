@@ -0,0 +1,311 @@
+/*
+Copyright 2023 Sangfor Technologies Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package memory
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"arsenal-os/internal/parse"
+	"arsenal-os/submodules"
+	"arsenal-os/util"
+
+	"golang.org/x/sys/unix"
+)
+
+func init() {
+	var newFaultType = pageCache{
+		FaultType: "memory-page-cache",
+	}
+	submodules.Add(newFaultType.FaultType, &newFaultType)
+}
+
+const (
+	dropCachesPath = "/proc/sys/vm/drop_caches"
+	// defaultThrashInterval 持续驱逐页缓存的默认周期。
+	defaultThrashInterval = time.Second
+	// floodFileName flood方式下用于填充页缓存的临时文件名。
+	floodFileName = "arsenal-page-cache-flood"
+	// defaultFloodDir /tmp在很多系统上是tmpfs，默认使用通常位于磁盘上的/var/tmp。
+	defaultFloodDir = "/var/tmp"
+	floodBlockSize  = 1 << 20
+	openFilePerm    = os.FileMode(0644)
+)
+
+var (
+	validPageCacheModes   = []string{"drop", "thrash"}
+	validThrashMethods    = []string{"evict", "flood"}
+	validDropCachesLevels = []string{"1", "2", "3"}
+)
+
+// pageCacheFloodState 记录flood方式创建的临时文件，keeper被强制杀死后清理时删除。
+type pageCacheFloodState struct {
+	FilePath string
+}
+
+type pageCache struct {
+	FaultType     string
+	flags         map[string]string
+	mode          string
+	method        string
+	level         string
+	interval      time.Duration
+	targetFiles   []string
+	floodFilePath string
+	floodSize     uint64
+}
+
+// targetFilesParser 收集--path指定的文件，目录下的普通文件递归加入。
+func (p *pageCache) targetFilesParser() error {
+	pathStr, ok := p.flags["path"]
+	if !ok {
+		return errors.New("please input param path")
+	}
+	for _, path := range strings.Split(pathStr, ",") {
+		err := filepath.Walk(path, func(filePath string, info os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			if info.Mode().IsRegular() {
+				p.targetFiles = append(p.targetFiles, filePath)
+			}
+			return nil
+		})
+		if err != nil {
+			return fmt.Errorf("walk path %s failed: %v", path, err)
+		}
+	}
+	if len(p.targetFiles) == 0 {
+		return fmt.Errorf("no regular file found in %s", pathStr)
+	}
+	return nil
+}
+
+func (p *pageCache) floodParser() error {
+	dir := defaultFloodDir
+	if value, ok := p.flags["dir"]; ok {
+		dir = value
+	}
+	fileInfo, err := os.Stat(dir)
+	if err != nil || !fileInfo.IsDir() {
+		return fmt.Errorf("please input valid flood directory: %s", dir)
+	}
+	// tmpfs上的文件本身就在页缓存中，无法被驱逐，也不会从磁盘重新读取。
+	var fsStat unix.Statfs_t
+	if err := unix.Statfs(dir, &fsStat); err != nil {
+		return fmt.Errorf("statfs %s failed: %v", dir, err)
+	}
+	if fsStat.Type == unix.TMPFS_MAGIC {
+		return fmt.Errorf("flood directory %s is on tmpfs, please input param dir on a disk filesystem", dir)
+	}
+	p.floodFilePath = filepath.Join(dir, floodFileName)
+
+	sizeStr, ok := p.flags["size"]
+	if !ok {
+		return errors.New("please input param size")
+	}
+	size, err := util.ParseSize(sizeStr)
+	if err != nil {
+		return fmt.Errorf("size param error: %v", err)
+	}
+	if size < floodBlockSize {
+		return fmt.Errorf("size must be larger than %s", util.FormatSize(floodBlockSize))
+	}
+	p.floodSize = size
+	return nil
+}
+
+func (p *pageCache) thrashParser() error {
+	p.method = "evict"
+	if method, ok := p.flags["method"]; ok {
+		p.method = method
+	}
+	if !util.IsValidValue(p.method, validThrashMethods) {
+		return fmt.Errorf("invalid method %s, example: %s", p.method, validThrashMethods)
+	}
+
+	p.interval = defaultThrashInterval
+	if intervalStr, ok := p.flags["interval-ms"]; ok {
+		interval, err := strconv.Atoi(intervalStr)
+		if err != nil || interval <= 0 {
+			return fmt.Errorf("interval-ms param(%s) must be a positive integer", intervalStr)
+		}
+		p.interval = time.Duration(interval) * time.Millisecond
+	}
+
+	if p.method == "flood" {
+		return p.floodParser()
+	}
+	return p.targetFilesParser()
+}
+
+func (p *pageCache) Prepare(inputArgs []string) error {
+	p.flags = parse.TransInputFlagsToMap(inputArgs)
+	p.mode = p.flags["mode"]
+	if !util.IsValidValue(p.mode, validPageCacheModes) {
+		return fmt.Errorf("invalid mode %s, example: %s", p.mode, validPageCacheModes)
+	}
+	if inputArgs[submodules.OpsTypeIndex] == submodules.Remove {
+		return nil
+	}
+
+	if p.mode == "drop" {
+		p.level = "3"
+		if level, ok := p.flags["level"]; ok {
+			p.level = level
+		}
+		if !util.IsValidValue(p.level, validDropCachesLevels) {
+			return fmt.Errorf("invalid level %s, example: %s", p.level, validDropCachesLevels)
+		}
+		return nil
+	}
+	return p.thrashParser()
+}
+
+// dropCaches 先将脏页写回磁盘，再按level释放页缓存(1)、dentry和inode缓存(2)或全部(3)。
+func (p *pageCache) dropCaches() error {
+	unix.Sync()
+	if err := ioutil.WriteFile(dropCachesPath, []byte(p.level), 0); err != nil {
+		return fmt.Errorf("write %s to %s failed: %v", p.level, dropCachesPath, err)
+	}
+	return nil
+}
+
+// evictFile 通过posix_fadvise(DONTNEED)驱逐文件在页缓存中的所有页。
+func evictFile(filePath string) error {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	return unix.Fadvise(int(file.Fd()), 0, 0, unix.FADV_DONTNEED)
+}
+
+func (p *pageCache) evictTargetFiles() {
+	for _, filePath := range p.targetFiles {
+		// 目标文件在注入期间可能被删除或替换，忽略单个文件的失败。
+		if err := evictFile(filePath); err != nil && !os.IsNotExist(err) {
+			fmt.Printf("evict %s page cache failed: %v\n", filePath, err)
+		}
+	}
+}
+
+func (p *pageCache) createFloodFile() error {
+	file, err := os.OpenFile(p.floodFilePath, os.O_CREATE|os.O_EXCL|os.O_WRONLY, openFilePerm)
+	if err != nil {
+		return fmt.Errorf("create flood file %s failed: %v", p.floodFilePath, err)
+	}
+	defer file.Close()
+
+	block := make([]byte, floodBlockSize)
+	for written := uint64(0); written < p.floodSize; written += floodBlockSize {
+		if _, err := file.Write(block); err != nil {
+			return fmt.Errorf("write flood file %s failed: %v", p.floodFilePath, err)
+		}
+	}
+	return nil
+}
+
+// floodCache 读取整个临时文件使其填满页缓存，读完后立即驱逐，下一轮重新从磁盘读取。
+func (p *pageCache) floodCache() error {
+	file, err := os.Open(p.floodFilePath)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	if _, err := io.Copy(ioutil.Discard, file); err != nil {
+		return fmt.Errorf("read flood file %s failed: %v", p.floodFilePath, err)
+	}
+	return unix.Fadvise(int(file.Fd()), 0, 0, unix.FADV_DONTNEED)
+}
+
+func (p *pageCache) thrash() error {
+	stopChan, err := util.StartKeeper(p.FaultType)
+	if err != nil {
+		return err
+	}
+	defer util.FinishKeeper(p.FaultType)
+
+	if p.method == "flood" {
+		if err := util.SaveState(p.FaultType, &pageCacheFloodState{FilePath: p.floodFilePath}); err != nil {
+			return err
+		}
+		defer util.RemoveState(p.FaultType)
+		defer os.Remove(p.floodFilePath)
+		if err := p.createFloodFile(); err != nil {
+			return err
+		}
+	}
+
+	ticker := time.NewTicker(p.interval)
+	defer ticker.Stop()
+	for {
+		if p.method == "flood" {
+			if err := p.floodCache(); err != nil {
+				fmt.Printf("%s flood page cache failed: %v\n", p.FaultType, err)
+			}
+		} else {
+			p.evictTargetFiles()
+		}
+
+		select {
+		case <-stopChan:
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
+
+func (p *pageCache) FaultInject(_ []string) error {
+	if p.mode == "drop" {
+		return p.dropCaches()
+	}
+	return p.thrash()
+}
+
+func (p *pageCache) FaultRemove(_ []string) error {
+	// 一次性释放缓存无需清理。
+	if p.mode == "drop" {
+		return nil
+	}
+	if err := util.StopKeeper(p.FaultType); err != nil {
+		return fmt.Errorf("remove %s failed: %v", p.FaultType, err)
+	}
+
+	// keeper被强制kill时不会删除临时文件，按注入时记录的路径删除。
+	if !util.StateIsExist(p.FaultType) {
+		return nil
+	}
+	var floodState pageCacheFloodState
+	if err := util.LoadState(p.FaultType, &floodState); err != nil {
+		return err
+	}
+	if util.FileIsExist(floodState.FilePath) {
+		if err := os.Remove(floodState.FilePath); err != nil {
+			return fmt.Errorf("remove flood file %s failed: %v", floodState.FilePath, err)
+		}
+	}
+	return util.RemoveState(p.FaultType)
+}
@@ -0,0 +1,265 @@
+/*
+Copyright 2023 Sangfor Technologies Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package memory
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+
+	"arsenal-os/internal/parse"
+	"arsenal-os/submodules"
+	"arsenal-os/util"
+
+	"golang.org/x/sys/unix"
+)
+
+func init() {
+	var newFaultType = poison{
+		FaultType: "memory-poison",
+	}
+	submodules.Add(newFaultType.FaultType, &newFaultType)
+}
+
+const (
+	// hardOfflinePagePath 写入物理地址后内核对该页执行memory_failure，与MADV_HWPOISON效果相同。
+	hardOfflinePagePath = "/sys/devices/system/memory/hard_offline_page"
+	// softOfflinePagePath 写入物理地址后内核将页内容迁移到新页并隔离原页，进程不感知。
+	softOfflinePagePath = "/sys/devices/system/memory/soft_offline_page"
+	// unpoisonPfnPath 由hwpoison_inject模块提供，用于清除页的hwpoison标记。
+	unpoisonPfnPath = "/sys/kernel/debug/hwpoison/unpoison-pfn"
+
+	pagemapEntrySize   = 8
+	pagemapPresentBit  = uint64(1) << 63
+	pagemapPfnMask     = (uint64(1) << 55) - 1
+	defaultPoisonCount = 1
+)
+
+var validPoisonModes = []string{"hard", "soft"}
+
+type poison struct {
+	FaultType string
+	flags     map[string]string
+	pid       int
+	mode      string
+	region    string
+	count     int
+}
+
+// poisonRecord 记录被注入的物理页，清理时尝试解除标记。
+type poisonRecord struct {
+	Mode string
+	Pfns []uint64
+}
+
+// memoryRegion /proc/<pid>/maps中的一段虚拟地址空间。
+type memoryRegion struct {
+	start uint64
+	end   uint64
+}
+
+func (p *poison) stateName() string {
+	return fmt.Sprintf("%s-%d", p.FaultType, p.pid)
+}
+
+func (p *poison) offlinePagePath() string {
+	if p.mode == "hard" {
+		return hardOfflinePagePath
+	}
+	return softOfflinePagePath
+}
+
+// findRegions 从/proc/<pid>/maps中查找路径名为region的映射，如：[heap]、[stack]或文件路径。
+func findRegions(pid int, region string) ([]memoryRegion, error) {
+	mapsPath := fmt.Sprintf("/proc/%d/maps", pid)
+	file, err := os.Open(mapsPath)
+	if err != nil {
+		return nil, fmt.Errorf("open %s failed: %v", mapsPath, err)
+	}
+	defer file.Close()
+
+	var regions []memoryRegion
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		// 行格式为：55d0c4a1e000-55d0c4a3f000 rw-p 00000000 00:00 0    [heap]。
+		fields := strings.Fields(scanner.Text())
+		const pathIndex = 5
+		if len(fields) <= pathIndex || strings.Join(fields[pathIndex:], " ") != region {
+			continue
+		}
+		addresses := strings.Split(fields[0], "-")
+		if len(addresses) != 2 {
+			continue
+		}
+		start, err := strconv.ParseUint(addresses[0], 16, 64)
+		if err != nil {
+			return nil, fmt.Errorf("parse %s address failed: %v", mapsPath, err)
+		}
+		end, err := strconv.ParseUint(addresses[1], 16, 64)
+		if err != nil {
+			return nil, fmt.Errorf("parse %s address failed: %v", mapsPath, err)
+		}
+		regions = append(regions, memoryRegion{start: start, end: end})
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("read %s failed: %v", mapsPath, err)
+	}
+	if len(regions) == 0 {
+		return nil, fmt.Errorf("region %s is not found in %s", region, mapsPath)
+	}
+	return regions, nil
+}
+
+// residentPfns 通过/proc/<pid>/pagemap获取区域内已分配物理内存的页帧号，最多返回count个。
+func residentPfns(pid int, regions []memoryRegion, count int) ([]uint64, error) {
+	pagemapPath := fmt.Sprintf("/proc/%d/pagemap", pid)
+	file, err := os.Open(pagemapPath)
+	if err != nil {
+		return nil, fmt.Errorf("open %s failed: %v", pagemapPath, err)
+	}
+	defer file.Close()
+
+	pageSize := uint64(unix.Getpagesize())
+	entry := make([]byte, pagemapEntrySize)
+	var pfns []uint64
+	for _, region := range regions {
+		for address := region.start; address < region.end && len(pfns) < count; address += pageSize {
+			if _, err := file.ReadAt(entry, int64(address/pageSize*pagemapEntrySize)); err != nil {
+				return nil, fmt.Errorf("read %s failed: %v", pagemapPath, err)
+			}
+			value := binary.LittleEndian.Uint64(entry)
+			// 没有CAP_SYS_ADMIN时内核返回的页帧号为0。
+			if value&pagemapPresentBit == 0 || value&pagemapPfnMask == 0 {
+				continue
+			}
+			pfns = append(pfns, value&pagemapPfnMask)
+		}
+	}
+	return pfns, nil
+}
+
+func (p *poison) Prepare(inputArgs []string) error {
+	p.flags = parse.TransInputFlagsToMap(inputArgs)
+	// 硬件错误注入后目标进程可能已被SIGBUS杀死，清理时只需要pid用于查找注入记录。
+	pid, err := util.GetProcessPidAndExistCheck(p.flags)
+	if err != nil && (pid < 0 || inputArgs[submodules.OpsTypeIndex] != submodules.Remove) {
+		return err
+	}
+	p.pid = pid
+	if inputArgs[submodules.OpsTypeIndex] == submodules.Remove {
+		return nil
+	}
+
+	force, err := parse.GetBoolFlag(p.flags, "force")
+	if err != nil {
+		return err
+	}
+	if !force {
+		return errors.New("memory poison may kill the process or crash the system, please input param force with true")
+	}
+	if !util.HasCapability(unix.CAP_SYS_ADMIN) {
+		return errors.New("memory poison requires CAP_SYS_ADMIN capability")
+	}
+
+	p.mode = "soft"
+	if mode, ok := p.flags["mode"]; ok {
+		p.mode = mode
+	}
+	if !util.IsValidValue(p.mode, validPoisonModes) {
+		return fmt.Errorf("invalid mode %s, example: %s", p.mode, validPoisonModes)
+	}
+	if !util.FileIsExist(p.offlinePagePath()) {
+		return fmt.Errorf("can't found %s, kernel is not built with CONFIG_MEMORY_FAILURE", p.offlinePagePath())
+	}
+
+	p.region = "[heap]"
+	if region, ok := p.flags["region"]; ok {
+		p.region = region
+	}
+	p.count = defaultPoisonCount
+	if countStr, ok := p.flags["count"]; ok {
+		count, err := strconv.Atoi(countStr)
+		if err != nil || count <= 0 {
+			return fmt.Errorf("count param(%s) must be a positive integer", countStr)
+		}
+		p.count = count
+	}
+	return nil
+}
+
+func (p *poison) FaultInject(_ []string) error {
+	if util.StateIsExist(p.stateName()) {
+		return fmt.Errorf("%s fault has been injected to process %d", p.FaultType, p.pid)
+	}
+
+	regions, err := findRegions(p.pid, p.region)
+	if err != nil {
+		return err
+	}
+	pfns, err := residentPfns(p.pid, regions, p.count)
+	if err != nil {
+		return err
+	}
+	if len(pfns) < p.count {
+		return fmt.Errorf("only %d resident pages are found in region %s, less than %d", len(pfns), p.region, p.count)
+	}
+
+	record := poisonRecord{Mode: p.mode}
+	defer func() {
+		if len(record.Pfns) != 0 {
+			util.SaveState(p.stateName(), &record)
+		}
+	}()
+	pageSize := uint64(unix.Getpagesize())
+	for _, pfn := range pfns {
+		address := fmt.Sprintf("0x%x", pfn*pageSize)
+		if err := ioutil.WriteFile(p.offlinePagePath(), []byte(address), 0); err != nil {
+			return fmt.Errorf("write %s to %s failed: %v", address, p.offlinePagePath(), err)
+		}
+		record.Pfns = append(record.Pfns, pfn)
+		fmt.Printf("%s offline pfn: 0x%x\n", p.mode, pfn)
+	}
+	return nil
+}
+
+func (p *poison) FaultRemove(_ []string) error {
+	if !util.StateIsExist(p.stateName()) {
+		return nil
+	}
+	var record poisonRecord
+	if err := util.LoadState(p.stateName(), &record); err != nil {
+		return err
+	}
+
+	// 被标记的物理页不会再被内核分配，没有加载hwpoison_inject模块时只能重启恢复。
+	if !util.FileIsExist(unpoisonPfnPath) {
+		fmt.Printf("warning: can't found %s, poisoned pages will be recovered after reboot\n", unpoisonPfnPath)
+		return util.RemoveState(p.stateName())
+	}
+	for _, pfn := range record.Pfns {
+		pfnStr := fmt.Sprintf("0x%x", pfn)
+		if err := ioutil.WriteFile(unpoisonPfnPath, []byte(pfnStr), 0); err != nil {
+			return fmt.Errorf("write %s to %s failed: %v", pfnStr, unpoisonPfnPath, err)
+		}
+	}
+	return util.RemoveState(p.stateName())
+}
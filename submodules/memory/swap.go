@@ -0,0 +1,311 @@
+/*
+Copyright 2023 Sangfor Technologies Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package memory
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+	"unsafe"
+
+	"arsenal-os/internal/parse"
+	"arsenal-os/submodules"
+	"arsenal-os/util"
+
+	"golang.org/x/sys/unix"
+)
+
+func init() {
+	var newFaultType = swap{
+		FaultType: "memory-swap",
+	}
+	submodules.Add(newFaultType.FaultType, &newFaultType)
+}
+
+const (
+	procSwapsPath = "/proc/swaps"
+	// swapFillInterval fill模式下每申请一块内存后等待内核换出的时间。
+	swapFillInterval = 200 * time.Millisecond
+	// swapFlagPrefer和swapFlagPrioMask swapon指定优先级的标志，定义见include/linux/swap.h。
+	swapFlagPrefer   = 0x8000
+	swapFlagPrioMask = 0x7fff
+)
+
+var validSwapModes = []string{"off", "fill"}
+
+type swap struct {
+	FaultType string
+	flags     map[string]string
+	mode      string
+	devices   []swapDevice
+	percent   float64
+}
+
+// swapDevice /proc/swaps中的一条swap设备信息。
+type swapDevice struct {
+	Filename string
+	Priority int
+}
+
+// swapBackup 记录被swapoff的设备及其优先级，清理时按原优先级swapon。
+type swapBackup struct {
+	Devices []swapDevice
+}
+
+func readSwaps() ([]swapDevice, error) {
+	file, err := os.Open(procSwapsPath)
+	if err != nil {
+		return nil, fmt.Errorf("open %s failed: %v", procSwapsPath, err)
+	}
+	defer file.Close()
+
+	var devices []swapDevice
+	scanner := bufio.NewScanner(file)
+	// 跳过表头：Filename Type Size Used Priority。
+	scanner.Scan()
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		const priorityIndex = 4
+		if len(fields) <= priorityIndex {
+			continue
+		}
+		priority, err := strconv.Atoi(fields[priorityIndex])
+		if err != nil {
+			return nil, fmt.Errorf("trans swap %s priority to int failed: %v", fields[0], err)
+		}
+		// 文件名中的空格在/proc/swaps中被转义为\040。
+		devices = append(devices, swapDevice{
+			Filename: strings.ReplaceAll(fields[0], "\\040", " "),
+			Priority: priority,
+		})
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("read %s failed: %v", procSwapsPath, err)
+	}
+	return devices, nil
+}
+
+// devicesParser 获取需要swapoff的设备，未指定--device时选择所有swap设备。
+func (s *swap) devicesParser() error {
+	devices, err := readSwaps()
+	if err != nil {
+		return err
+	}
+	if len(devices) == 0 {
+		return errors.New("no swap device is in use")
+	}
+
+	deviceStr, ok := s.flags["device"]
+	if !ok {
+		s.devices = devices
+		return nil
+	}
+	for _, name := range strings.Split(deviceStr, ",") {
+		found := false
+		for _, device := range devices {
+			if device.Filename == name {
+				s.devices = append(s.devices, device)
+				found = true
+				break
+			}
+		}
+		if !found {
+			return fmt.Errorf("swap device %s is not in use", name)
+		}
+	}
+	return nil
+}
+
+func (s *swap) Prepare(inputArgs []string) error {
+	s.flags = parse.TransInputFlagsToMap(inputArgs)
+	s.mode = s.flags["mode"]
+	if !util.IsValidValue(s.mode, validSwapModes) {
+		return fmt.Errorf("invalid mode %s, example: %s", s.mode, validSwapModes)
+	}
+	if inputArgs[submodules.OpsTypeIndex] == submodules.Remove {
+		return nil
+	}
+
+	if s.mode == "off" {
+		return s.devicesParser()
+	}
+	percentStr, ok := s.flags["percent"]
+	if !ok {
+		return errors.New("please input param percent")
+	}
+	percent, err := parsePercent("percent", percentStr)
+	if err != nil {
+		return err
+	}
+	s.percent = percent
+	swapTotal, err := util.GetMemInfoItem("SwapTotal")
+	if err != nil {
+		return err
+	}
+	if swapTotal == 0 {
+		return errors.New("no swap device is in use")
+	}
+	return nil
+}
+
+// swapOffDevice 直接调用swapoff系统调用，设备名不经过shell解析。
+func swapOffDevice(filename string) error {
+	path, err := unix.BytePtrFromString(filename)
+	if err != nil {
+		return err
+	}
+	if _, _, errno := unix.Syscall(unix.SYS_SWAPOFF, uintptr(unsafe.Pointer(path)), 0, 0); errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+// swapOnDevice 直接调用swapon系统调用，设备名不经过shell解析。
+func swapOnDevice(filename string, flags int) error {
+	path, err := unix.BytePtrFromString(filename)
+	if err != nil {
+		return err
+	}
+	if _, _, errno := unix.Syscall(unix.SYS_SWAPON, uintptr(unsafe.Pointer(path)), uintptr(flags), 0); errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+func (s *swap) swapOff() error {
+	if util.StateIsExist(s.FaultType) {
+		return fmt.Errorf("%s fault has been injected", s.FaultType)
+	}
+
+	backup := swapBackup{Devices: s.devices}
+	if err := util.SaveState(s.FaultType, &backup); err != nil {
+		return err
+	}
+	for _, device := range s.devices {
+		// swapoff需要将swap中的数据换入内存，耗时与swap使用量相关。
+		if err := swapOffDevice(device.Filename); err != nil {
+			return fmt.Errorf("swapoff %s failed: %v", device.Filename, err)
+		}
+	}
+	return nil
+}
+
+func (s *swap) swapOn() error {
+	var backup swapBackup
+	if err := util.LoadState(s.FaultType, &backup); err != nil {
+		return fmt.Errorf("%s load swap devices failed: %v", s.FaultType, err)
+	}
+	devices, err := readSwaps()
+	if err != nil {
+		return err
+	}
+
+	for _, device := range backup.Devices {
+		isOn := false
+		for _, current := range devices {
+			if current.Filename == device.Filename {
+				isOn = true
+				break
+			}
+		}
+		if isOn {
+			continue
+		}
+		// 负数优先级是内核自动分配的，swapon不允许指定负数优先级。
+		flags := 0
+		if device.Priority >= 0 {
+			flags = swapFlagPrefer | device.Priority&swapFlagPrioMask
+		}
+		if err := swapOnDevice(device.Filename, flags); err != nil {
+			return fmt.Errorf("swapon %s failed: %v", device.Filename, err)
+		}
+	}
+	return util.RemoveState(s.FaultType)
+}
+
+// swapUsedPercent 返回当前swap使用率。
+func swapUsedPercent() (float64, error) {
+	memInfo, err := util.ReadMemInfo()
+	if err != nil {
+		return 0, err
+	}
+	if memInfo["SwapTotal"] == 0 {
+		return 0, errors.New("no swap device is in use")
+	}
+	return float64(memInfo["SwapTotal"]-memInfo["SwapFree"]) * 100 / float64(memInfo["SwapTotal"]), nil
+}
+
+// swapFill 持续申请匿名内存迫使内核换出，直到swap使用率达到目标值。
+func (s *swap) swapFill() error {
+	stopChan, err := util.StartKeeper(s.FaultType)
+	if err != nil {
+		return err
+	}
+	defer util.FinishKeeper(s.FaultType)
+
+	var memory util.AnonMemory
+	defer memory.Release()
+	ticker := time.NewTicker(swapFillInterval)
+	defer ticker.Stop()
+	isReached := false
+	for {
+		if !isReached {
+			percent, err := swapUsedPercent()
+			if err != nil {
+				return err
+			}
+			available, err := util.GetMemInfoItem("MemAvailable")
+			if err != nil {
+				return err
+			}
+			if percent >= s.percent || available < oomGuardMinReserve {
+				// 内核不再换出(如swappiness为0)时可用内存会持续下降，停止申请避免触发OOM killer。
+				isReached = true
+				fmt.Printf("swap used %.2f%%, hold %s anonymous memory\n", percent, util.FormatSize(memory.Size()))
+			} else if err := memory.Grow(util.DefaultMemoryChunkSize); err != nil {
+				fmt.Printf("%s grow memory failed: %v\n", s.FaultType, err)
+			}
+		}
+
+		select {
+		case <-stopChan:
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
+
+func (s *swap) FaultInject(_ []string) error {
+	if s.mode == "off" {
+		return s.swapOff()
+	}
+	return s.swapFill()
+}
+
+func (s *swap) FaultRemove(_ []string) error {
+	if s.mode == "off" {
+		return s.swapOn()
+	}
+	if err := util.StopKeeper(s.FaultType); err != nil {
+		return fmt.Errorf("remove %s failed: %v", s.FaultType, err)
+	}
+	return nil
+}
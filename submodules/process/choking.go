@@ -19,8 +19,8 @@ package process
 import (
 	"errors"
 	"fmt"
+	"math/rand"
 	"strconv"
-	"strings"
 	"syscall"
 	"time"
 
@@ -39,72 +39,180 @@ func init() {
 type choking struct {
 	FaultType string
 	flags     map[string]string
-	pid       int
-	interval  int
+	pids      []int
+	stopTime  time.Duration
+	runTime   time.Duration
+	jitter    time.Duration
+	duration  time.Duration
 }
 
-// Prepare 获取输入参数maps，初始化opsInfo信息，检查进程是否存在。
-func (c *choking) Prepare(inputArgs []string) error {
-	dependCmd := []string{"ps", "grep", "awk"}
-	if missingCmd, isMissCmd := util.CheckEnvShellCommand(dependCmd); isMissCmd {
-		return fmt.Errorf("missing command: %s", missingCmd)
+// chokingTargets 记录被暂停的进程，清理时保证每个进程都能收到SIGCONT。
+type chokingTargets struct {
+	Pids []int
+}
+
+func (c *choking) stateName() string {
+	return util.SelectorStateName(c.FaultType, c.flags)
+}
+
+// parseMillisecondFlag 解析以毫秒为单位的参数，参数不存在时返回defaultValue。
+func (c *choking) parseMillisecondFlag(name string, defaultValue time.Duration) (time.Duration, error) {
+	valueStr, ok := c.flags[name]
+	if !ok {
+		return defaultValue, nil
+	}
+	value, err := strconv.Atoi(valueStr)
+	if err != nil || value < 0 {
+		return 0, fmt.Errorf("%s param(%s) must be a non-negative integer", name, valueStr)
+	}
+	return time.Duration(value) * time.Millisecond, nil
+}
+
+// cycleParser 解析暂停和运行时长，兼容以秒为单位同时指定两者的--interval参数。
+func (c *choking) cycleParser() error {
+	var interval time.Duration
+	if intervalStr, ok := c.flags["interval"]; ok {
+		value, err := strconv.Atoi(intervalStr)
+		if err != nil || value <= 0 {
+			return fmt.Errorf("interval param(%s) must be a positive integer", intervalStr)
+		}
+		interval = time.Duration(value) * time.Second
+	}
+
+	var err error
+	if c.stopTime, err = c.parseMillisecondFlag("stop-ms", interval); err != nil {
+		return err
+	}
+	if c.runTime, err = c.parseMillisecondFlag("run-ms", interval); err != nil {
+		return err
+	}
+	if c.stopTime == 0 || c.runTime == 0 {
+		return errors.New("please input param stop-ms and run-ms, or interval")
+	}
+	if c.jitter, err = c.parseMillisecondFlag("jitter-ms", 0); err != nil {
+		return err
 	}
+	if c.jitter >= c.stopTime || c.jitter >= c.runTime {
+		return errors.New("jitter-ms must be less than stop-ms and run-ms")
+	}
+
+	if durationStr, ok := c.flags["duration"]; ok {
+		value, err := strconv.Atoi(durationStr)
+		if err != nil || value <= 0 {
+			return fmt.Errorf("duration param(%s) must be a positive integer", durationStr)
+		}
+		c.duration = time.Duration(value) * time.Second
+	}
+	return nil
+}
+
+// Prepare 获取输入参数maps，检查进程是否存在并解析暂停周期。
+func (c *choking) Prepare(inputArgs []string) error {
 	c.flags = parse.TransInputFlagsToMap(inputArgs)
+	// 清理时从注入记录中获取目标进程。
+	if inputArgs[submodules.OpsTypeIndex] == submodules.Remove {
+		return nil
+	}
 
-	pid, err := GetProcessPidAndExistCheck(c.flags)
+	pids, err := util.GetTargetProcesses(c.flags)
 	if err != nil {
 		return err
 	}
-	c.pid = pid
+	c.pids = pids
+	return c.cycleParser()
+}
 
-	if _, ok := c.flags["interval"]; !ok {
-		return errors.New("prepare failed when get interval failed")
+// withJitter 在base基础上增加[-jitter, jitter]范围内的随机偏移。
+func withJitter(random *rand.Rand, base, jitter time.Duration) time.Duration {
+	if jitter == 0 {
+		return base
 	}
-	interval, err := strconv.Atoi(c.flags["interval"])
-	if err != nil {
-		return fmt.Errorf("prepare failed when trans interval string to int failed, error: %v", err)
+	return base + time.Duration(random.Int63n(int64(2*jitter)+1)) - jitter
+}
+
+// signalTargets 向所有目标进程发送信号，返回仍然存在的进程。
+func (c *choking) signalTargets(signal syscall.Signal) []int {
+	var alivePids []int
+	for _, pid := range c.pids {
+		if err := syscall.Kill(pid, signal); err != nil {
+			if err != syscall.ESRCH {
+				fmt.Printf("send signal: %s to %d failed: %v\n", signal, pid, err)
+			}
+			continue
+		}
+		alivePids = append(alivePids, pid)
 	}
-	c.interval = interval
-	return nil
+	return alivePids
 }
 
+// FaultInject 后台常驻，按照暂停和运行时长交替向目标进程发送SIGSTOP和SIGCONT。
 func (c *choking) FaultInject(_ []string) error {
-	// TODO: 定时器实现。
+	if util.StateIsExist(c.stateName()) || util.KeeperIsRunning(c.stateName()) {
+		return fmt.Errorf("%s fault has been injected", c.FaultType)
+	}
+	if err := util.SaveState(c.stateName(), &chokingTargets{Pids: c.pids}); err != nil {
+		return err
+	}
+	stopChan, err := util.StartKeeper(c.stateName())
+	if err != nil {
+		util.RemoveState(c.stateName())
+		return err
+	}
+	defer util.FinishKeeper(c.stateName())
+	defer util.RemoveState(c.stateName())
+	// 无论以何种方式退出，都需要恢复目标进程运行。
+	defer c.signalTargets(syscall.SIGCONT)
+
+	var durationChan <-chan time.Time
+	if c.duration != 0 {
+		durationTimer := time.NewTimer(c.duration)
+		defer durationTimer.Stop()
+		durationChan = durationTimer.C
+	}
+
+	random := rand.New(rand.NewSource(time.Now().UnixNano()))
+	// 第一个周期立即开始暂停阶段。
+	phaseTimer := time.NewTimer(0)
+	defer phaseTimer.Stop()
+	isStopped := false
 	for {
-		if err := syscall.Kill(c.pid, syscall.SIGSTOP); err != nil {
-			return fmt.Errorf("send signal: SIGSTOP to %d failed", c.pid)
+		select {
+		case <-stopChan:
+			return nil
+		case <-durationChan:
+			return nil
+		case <-phaseTimer.C:
 		}
-		time.Sleep(time.Duration(c.interval) * time.Second)
 
-		if err := syscall.Kill(c.pid, syscall.SIGCONT); err != nil {
-			return fmt.Errorf("send signal: SIGCONT to %d failed", c.pid)
+		if isStopped {
+			c.pids = c.signalTargets(syscall.SIGCONT)
+			phaseTimer.Reset(withJitter(random, c.runTime, c.jitter))
+		} else {
+			c.pids = c.signalTargets(syscall.SIGSTOP)
+			phaseTimer.Reset(withJitter(random, c.stopTime, c.jitter))
+		}
+		isStopped = !isStopped
+		if len(c.pids) == 0 {
+			return errors.New("all target processes have exited")
 		}
-		time.Sleep((time.Duration(c.interval)) * time.Second)
 	}
 }
 
-func (c *choking) FaultRemove(inputArgs []string) error {
-	// remove命令替换成inject命令并查找进程对应的pid。
-	removeCommand := strings.Join(inputArgs, " ")
-	injectCommand := strings.ReplaceAll(removeCommand, submodules.Remove, submodules.Inject)
-	shellCmd := fmt.Sprintf("ps aux | grep '%s' | grep -v grep | awk '{print $2}'", injectCommand)
-	pidStr, err := util.ExecCommandBlock(shellCmd)
-	if err != nil {
-		return fmt.Errorf("%s get backup running process id failed: %v", c.FaultType, err)
-	}
-
-	pid, err := strconv.Atoi(strings.Trim(pidStr, "\n"))
-	if err != nil {
-		return fmt.Errorf("%s trans pid string to int failed: %v", c.FaultType, err)
+func (c *choking) FaultRemove(_ []string) error {
+	if err := util.StopKeeper(c.stateName()); err != nil {
+		return fmt.Errorf("remove %s failed: %v", c.FaultType, err)
 	}
-	if err = syscall.Kill(pid, syscall.SIGKILL); err != nil {
-		return fmt.Errorf("%s kill backup running process failed: %v", c.FaultType, err)
+	if !util.StateIsExist(c.stateName()) {
+		return nil
 	}
 
-	// 后台发送信号进程退出时可能已经向目标进程发送SIGSTOP，确保被故障注入的程序能够正常运行，
+	// keeper被强制kill时可能停留在暂停阶段，确保被故障注入的程序能够正常运行，
 	// 重新发送一次SIGCONT信号。
-	if err := syscall.Kill(c.pid, syscall.SIGCONT); err != nil {
-		return fmt.Errorf("send signal: SIGCONT to %d failed: %v", c.pid, err)
+	var targets chokingTargets
+	if err := util.LoadState(c.stateName(), &targets); err != nil {
+		return err
 	}
-	return nil
+	c.pids = targets.Pids
+	c.signalTargets(syscall.SIGCONT)
+	return util.RemoveState(c.stateName())
 }
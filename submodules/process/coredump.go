@@ -0,0 +1,174 @@
+/*
+Copyright 2023 Sangfor Technologies Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package process
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+const (
+	corePatternPath = "/proc/sys/kernel/core_pattern"
+	coreUsesPidPath = "/proc/sys/kernel/core_uses_pid"
+)
+
+// coreSignals 默认动作为生成core文件的信号。
+var coreSignals = []syscall.Signal{
+	syscall.SIGQUIT, syscall.SIGILL, syscall.SIGTRAP, syscall.SIGABRT, syscall.SIGBUS,
+	syscall.SIGFPE, syscall.SIGSEGV, syscall.SIGSYS, syscall.SIGXCPU, syscall.SIGXFSZ,
+}
+
+// coreDumpInfo 目标进程退出前收集的core文件相关信息，进程退出后/proc下的信息不再可用。
+type coreDumpInfo struct {
+	pid       int
+	comm      string
+	cwd       string
+	uid       string
+	coreLimit string
+	pattern   string
+	usesPid   bool
+	killTime  time.Time
+}
+
+func collectCoreDumpInfo(pid int) *coreDumpInfo {
+	info := coreDumpInfo{pid: pid, killTime: time.Now()}
+	if data, err := ioutil.ReadFile(corePatternPath); err == nil {
+		info.pattern = strings.TrimSpace(string(data))
+	}
+	if data, err := ioutil.ReadFile(coreUsesPidPath); err == nil {
+		info.usesPid = strings.TrimSpace(string(data)) != "0"
+	}
+	if data, err := ioutil.ReadFile(fmt.Sprintf("/proc/%d/comm", pid)); err == nil {
+		info.comm = strings.TrimSpace(string(data))
+	}
+	info.cwd, _ = os.Readlink(fmt.Sprintf("/proc/%d/cwd", pid))
+
+	if data, err := ioutil.ReadFile(fmt.Sprintf("/proc/%d/status", pid)); err == nil {
+		for _, line := range strings.Split(string(data), "\n") {
+			if fields := strings.Fields(line); len(fields) > 1 && fields[0] == "Uid:" {
+				info.uid = fields[1]
+				break
+			}
+		}
+	}
+	if data, err := ioutil.ReadFile(fmt.Sprintf("/proc/%d/limits", pid)); err == nil {
+		// 行格式为：Max core file size        0                    unlimited            bytes。
+		for _, line := range strings.Split(string(data), "\n") {
+			if strings.HasPrefix(line, "Max core file size") {
+				if fields := strings.Fields(strings.TrimPrefix(line, "Max core file size")); len(fields) != 0 {
+					info.coreLimit = fields[0]
+				}
+				break
+			}
+		}
+	}
+	return &info
+}
+
+// patternToGlob 将core_pattern中的格式符替换为实际值，无法确定的格式符替换为通配符。
+func (c *coreDumpInfo) patternToGlob(signal syscall.Signal) string {
+	var builder strings.Builder
+	hasPid := false
+	for index := 0; index < len(c.pattern); index++ {
+		if c.pattern[index] != '%' || index+1 == len(c.pattern) {
+			builder.WriteByte(c.pattern[index])
+			continue
+		}
+		index++
+		switch c.pattern[index] {
+		case '%':
+			builder.WriteByte('%')
+		case 'p', 'P':
+			hasPid = true
+			builder.WriteString(strconv.Itoa(c.pid))
+		case 'u':
+			builder.WriteString(c.uid)
+		case 's':
+			builder.WriteString(strconv.Itoa(int(signal)))
+		case 'e':
+			builder.WriteString(c.comm)
+		case 'h':
+			hostname, _ := os.Hostname()
+			builder.WriteString(hostname)
+		default:
+			builder.WriteByte('*')
+		}
+	}
+	glob := builder.String()
+	if c.usesPid && !hasPid {
+		glob = fmt.Sprintf("%s.%d", glob, c.pid)
+	}
+	// 不包含路径时core文件生成在进程的工作目录下。
+	if !strings.Contains(glob, "/") {
+		glob = filepath.Join(c.cwd, glob)
+	}
+	return glob
+}
+
+// findCoreFile 查找进程被杀死后生成的core文件。
+func (c *coreDumpInfo) findCoreFile(signal syscall.Signal) (string, string) {
+	glob := c.patternToGlob(signal)
+	matches, _ := filepath.Glob(glob)
+	for _, match := range matches {
+		fileInfo, err := os.Stat(match)
+		if err != nil || !fileInfo.Mode().IsRegular() {
+			continue
+		}
+		// 文件时间精度可能低于纳秒，预留1秒误差。
+		if fileInfo.ModTime().After(c.killTime.Add(-time.Second)) {
+			return match, glob
+		}
+	}
+	return "", glob
+}
+
+// report 根据退出信号和wait状态中的core dump标记输出core文件的生成情况。
+func (c *coreDumpInfo) report(signal syscall.Signal, isDumped bool) {
+	isCoreSignal := false
+	for _, coreSignal := range coreSignals {
+		if coreSignal == signal {
+			isCoreSignal = true
+			break
+		}
+	}
+	if !isCoreSignal {
+		fmt.Printf("process %d: signal %s does not produce core dump\n", c.pid, signalName(signal))
+		return
+	}
+
+	if strings.HasPrefix(c.pattern, "|") {
+		fmt.Printf("process %d: core dumped: %t, core is piped to handler: %s\n",
+			c.pid, isDumped, strings.TrimSpace(strings.TrimPrefix(c.pattern, "|")))
+		return
+	}
+	if !isDumped {
+		fmt.Printf("process %d: core dumped: false, core file size limit: %s\n", c.pid, c.coreLimit)
+		return
+	}
+	coreFile, glob := c.findCoreFile(signal)
+	if coreFile == "" {
+		fmt.Printf("process %d: core dumped: true, but core file is not found by pattern %s\n", c.pid, glob)
+		return
+	}
+	fmt.Printf("process %d: core dumped: true, core file: %s\n", c.pid, coreFile)
+}
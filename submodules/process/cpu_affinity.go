@@ -0,0 +1,208 @@
+/*
+Copyright 2023 Sangfor Technologies Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package process
+
+import (
+	"errors"
+	"fmt"
+
+	"arsenal-os/internal/parse"
+	"arsenal-os/submodules"
+	"arsenal-os/util"
+
+	"golang.org/x/sys/unix"
+)
+
+func init() {
+	var newFaultType = cpuAffinity{
+		FaultType: "process-cpu-affinity",
+	}
+	submodules.Add(newFaultType.FaultType, &newFaultType)
+}
+
+type cpuAffinity struct {
+	FaultType  string
+	flags      map[string]string
+	pid        int
+	cpuList    []int
+	allThreads bool
+}
+
+// cpuAffinityBackup 故障注入前被修改线程原始的cpu亲和性，key为tid，
+// Threads记录注入时进程的所有线程，StartTime用于清理时识别pid是否被复用。
+type cpuAffinityBackup struct {
+	StartTime uint64
+	Threads   []int
+	Masks     map[int][]int
+}
+
+func (c *cpuAffinity) stateName() string {
+	return fmt.Sprintf("%s-%d", c.FaultType, c.pid)
+}
+
+func (c *cpuAffinity) cpuListParser() error {
+	cpuListString, ok := c.flags["cpu-list"]
+	if !ok {
+		return errors.New("please input param cpu-list")
+	}
+	cpuList, err := util.ParseCPUList(cpuListString)
+	if err != nil {
+		return fmt.Errorf("cpu-list param error: %v", err)
+	}
+
+	// 目标cpu必须处于online状态，否则sched_setaffinity会返回EINVAL。
+	if err := util.CheckCPUListOnline(cpuList); err != nil {
+		return err
+	}
+	c.cpuList = cpuList
+	return nil
+}
+
+func (c *cpuAffinity) Prepare(inputArgs []string) error {
+	c.flags = parse.TransInputFlagsToMap(inputArgs)
+	// 清理时目标进程可能已经退出，只需要pid用于查找注入记录。
+	pid, err := util.GetProcessPidAndExistCheck(c.flags)
+	if err != nil && (pid < 0 || inputArgs[submodules.OpsTypeIndex] != submodules.Remove) {
+		return err
+	}
+	c.pid = pid
+
+	allThreads, err := parse.GetBoolFlag(c.flags, "all-threads")
+	if err != nil {
+		return err
+	}
+	c.allThreads = allThreads
+
+	// 清理时依据保存的原始亲和性恢复，不需要校验cpu-list。
+	if inputArgs[submodules.OpsTypeIndex] == submodules.Remove {
+		return nil
+	}
+	return c.cpuListParser()
+}
+
+func (c *cpuAffinity) targetThreadIDs() ([]int, error) {
+	if !c.allThreads {
+		return []int{c.pid}, nil
+	}
+	return util.GetProcessThreadIDs(c.pid)
+}
+
+func getThreadCPUList(tid int) ([]int, error) {
+	var cpuSet unix.CPUSet
+	if err := unix.SchedGetaffinity(tid, &cpuSet); err != nil {
+		return nil, err
+	}
+
+	var cpuList []int
+	for cpuID := 0; len(cpuList) < cpuSet.Count(); cpuID++ {
+		if cpuSet.IsSet(cpuID) {
+			cpuList = append(cpuList, cpuID)
+		}
+	}
+	return cpuList, nil
+}
+
+func setThreadCPUList(tid int, cpuList []int) error {
+	var cpuSet unix.CPUSet
+	cpuSet.Zero()
+	for _, cpuID := range cpuList {
+		cpuSet.Set(cpuID)
+	}
+	return unix.SchedSetaffinity(tid, &cpuSet)
+}
+
+func (c *cpuAffinity) FaultInject(_ []string) error {
+	if util.StateIsExist(c.stateName()) {
+		return fmt.Errorf("process %d has been injected %s fault", c.pid, c.FaultType)
+	}
+
+	startTime, err := util.GetProcessStartTime(c.pid)
+	if err != nil {
+		return err
+	}
+	allTids, err := util.GetProcessThreadIDs(c.pid)
+	if err != nil {
+		return fmt.Errorf("get process %d threads failed: %v", c.pid, err)
+	}
+	tids, err := c.targetThreadIDs()
+	if err != nil {
+		return fmt.Errorf("get process %d threads failed: %v", c.pid, err)
+	}
+
+	// 先保存被修改线程的原始亲和性，再做修改，保证清理时可以完整恢复。
+	backup := cpuAffinityBackup{StartTime: startTime, Threads: allTids, Masks: make(map[int][]int, len(tids))}
+	for _, tid := range tids {
+		cpuList, err := getThreadCPUList(tid)
+		if err != nil {
+			// 线程可能在遍历过程中退出。
+			if err == unix.ESRCH {
+				continue
+			}
+			return fmt.Errorf("get thread %d cpu affinity failed: %v", tid, err)
+		}
+		backup.Masks[tid] = cpuList
+	}
+	if err := util.SaveState(c.stateName(), &backup); err != nil {
+		return err
+	}
+
+	for tid := range backup.Masks {
+		if err := setThreadCPUList(tid, c.cpuList); err != nil && err != unix.ESRCH {
+			return fmt.Errorf("set thread %d cpu affinity to %s failed: %v",
+				tid, util.FormatCPUList(c.cpuList), err)
+		}
+	}
+	return nil
+}
+
+func (c *cpuAffinity) FaultRemove(_ []string) error {
+	var backup cpuAffinityBackup
+	if err := util.LoadState(c.stateName(), &backup); err != nil {
+		return fmt.Errorf("%s load raw cpu affinity failed: %v", c.FaultType, err)
+	}
+
+	// 目标进程可能已经退出，或pid已经被重启后的其他进程复用。
+	if startTime, err := util.GetProcessStartTime(c.pid); err == nil && startTime == backup.StartTime {
+		tids, err := util.GetProcessThreadIDs(c.pid)
+		if err != nil {
+			return fmt.Errorf("get process %d threads failed: %v", c.pid, err)
+		}
+		existed := make(map[int]bool, len(backup.Threads))
+		for _, tid := range backup.Threads {
+			existed[tid] = true
+		}
+
+		// 只恢复被修改过的线程，与清理时是否指定--all-threads无关。
+		for _, tid := range tids {
+			cpuList, ok := backup.Masks[tid]
+			if !ok {
+				// 注入期间新创建的线程继承了被修改后的亲和性，主线程被修改过时按主线程的原始亲和性恢复。
+				if existed[tid] {
+					continue
+				}
+				if cpuList, ok = backup.Masks[c.pid]; !ok {
+					continue
+				}
+			}
+			if err := setThreadCPUList(tid, cpuList); err != nil && err != unix.ESRCH {
+				return fmt.Errorf("restore thread %d cpu affinity to %s failed: %v",
+					tid, util.FormatCPUList(cpuList), err)
+			}
+		}
+	}
+	return util.RemoveState(c.stateName())
+}
@@ -0,0 +1,242 @@
+/*
+Copyright 2023 Sangfor Technologies Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package process
+
+import (
+	"fmt"
+	"strconv"
+	"syscall"
+	"time"
+
+	"arsenal-os/internal/parse"
+	"arsenal-os/submodules"
+	"arsenal-os/util"
+)
+
+func init() {
+	var newFaultType = crashLoop{
+		FaultType: "process-crash-loop",
+	}
+	submodules.Add(newFaultType.FaultType, &newFaultType)
+}
+
+// crashLoopPollInterval 查找重新启动的目标进程的周期。
+const crashLoopPollInterval = 100 * time.Millisecond
+
+type crashLoop struct {
+	FaultType string
+	flags     map[string]string
+	selector  *util.ProcessSelector
+	signal    syscall.Signal
+	duration  time.Duration
+	maxKills  int
+	delay     time.Duration
+}
+
+// crashLoopStatus keeper每次杀死进程后更新的进度，用于状态查询。
+type crashLoopStatus struct {
+	Kills        int
+	LastKillPid  int
+	LastKillTime time.Time
+	StartTime    time.Time
+}
+
+// processKey 进程pid和启动时间唯一标识一个进程，防止pid复用后误判。
+type processKey struct {
+	pid       int
+	startTime uint64
+}
+
+func (c *crashLoop) stateName() string {
+	return util.SelectorStateName(c.FaultType, c.flags)
+}
+
+func (c *crashLoop) Prepare(inputArgs []string) error {
+	c.flags = parse.TransInputFlagsToMap(inputArgs)
+	opsType := inputArgs[submodules.OpsTypeIndex]
+	if opsType == submodules.Remove || opsType == submodules.Status {
+		return nil
+	}
+	// 被杀死的进程重启后pid会变化，只能通过选择器查找。
+	if _, ok := c.flags["pid"]; ok {
+		return fmt.Errorf("%s does not support param pid, please use name, cmdline-regex or unit", c.FaultType)
+	}
+	// 每轮都会杀死所有匹配的进程，select和count不生效，直接拒绝避免误解。
+	for _, name := range []string{"select", "count"} {
+		if _, ok := c.flags[name]; ok {
+			return fmt.Errorf("%s does not support param %s, please use kills to limit kill times", c.FaultType, name)
+		}
+	}
+	selector, err := util.NewProcessSelector(c.flags)
+	if err != nil {
+		return err
+	}
+	c.selector = selector
+
+	c.signal = syscall.SIGKILL
+	if signalStr, ok := c.flags["signal"]; ok {
+		if c.signal, err = parseSignal(signalStr); err != nil {
+			return err
+		}
+	}
+	if durationStr, ok := c.flags["duration"]; ok {
+		duration, err := strconv.Atoi(durationStr)
+		if err != nil || duration <= 0 {
+			return fmt.Errorf("duration param(%s) must be a positive integer", durationStr)
+		}
+		c.duration = time.Duration(duration) * time.Second
+	}
+	if killsStr, ok := c.flags["kills"]; ok {
+		if c.maxKills, err = strconv.Atoi(killsStr); err != nil || c.maxKills <= 0 {
+			return fmt.Errorf("kills param(%s) must be a positive integer", killsStr)
+		}
+	}
+	if delayStr, ok := c.flags["delay-ms"]; ok {
+		delay, err := strconv.Atoi(delayStr)
+		if err != nil || delay < 0 {
+			return fmt.Errorf("delay-ms param(%s) must be a non-negative integer", delayStr)
+		}
+		c.delay = time.Duration(delay) * time.Millisecond
+	}
+	return nil
+}
+
+// killMatched 杀死存活时间超过delay的匹配进程，最多杀死limit个，limit为0时不限制，返回本轮杀死的进程。
+func (c *crashLoop) killMatched(firstSeen map[processKey]time.Time, killed map[processKey]bool,
+	limit int) ([]int, error) {
+	matched, err := c.selector.MatchProcesses()
+	if err != nil {
+		return nil, err
+	}
+
+	var pids []int
+	current := make(map[processKey]bool)
+	for _, info := range matched {
+		key := processKey{pid: info.Pid, startTime: info.StartTime}
+		current[key] = true
+		if killed[key] || (limit != 0 && len(pids) >= limit) {
+			continue
+		}
+		if _, ok := firstSeen[key]; !ok {
+			firstSeen[key] = time.Now()
+		}
+		if time.Since(firstSeen[key]) < c.delay {
+			continue
+		}
+		if err := syscall.Kill(info.Pid, c.signal); err != nil {
+			if err != syscall.ESRCH {
+				fmt.Printf("send signal %s to process %d failed: %v\n", signalName(c.signal), info.Pid, err)
+			}
+			continue
+		}
+		killed[key] = true
+		pids = append(pids, info.Pid)
+	}
+	// 清理已经退出的进程，避免记录无限增长。
+	for key := range firstSeen {
+		if !current[key] {
+			delete(firstSeen, key)
+			delete(killed, key)
+		}
+	}
+	return pids, nil
+}
+
+// FaultInject 后台常驻，目标进程每次重新启动后都将其杀死，直到达到持续时间或杀死次数。
+func (c *crashLoop) FaultInject(_ []string) error {
+	if util.KeeperIsRunning(c.stateName()) {
+		return fmt.Errorf("%s fault has been injected", c.FaultType)
+	}
+	stopChan, err := util.StartKeeper(c.stateName())
+	if err != nil {
+		return err
+	}
+	defer util.FinishKeeper(c.stateName())
+	defer util.RemoveState(c.stateName())
+
+	status := crashLoopStatus{StartTime: time.Now()}
+	if err := util.SaveState(c.stateName(), &status); err != nil {
+		return err
+	}
+	var durationChan <-chan time.Time
+	if c.duration != 0 {
+		durationTimer := time.NewTimer(c.duration)
+		defer durationTimer.Stop()
+		durationChan = durationTimer.C
+	}
+
+	firstSeen := make(map[processKey]time.Time)
+	killed := make(map[processKey]bool)
+	ticker := time.NewTicker(crashLoopPollInterval)
+	defer ticker.Stop()
+	for {
+		limit := 0
+		if c.maxKills != 0 {
+			limit = c.maxKills - status.Kills
+		}
+		pids, err := c.killMatched(firstSeen, killed, limit)
+		if err != nil {
+			return err
+		}
+		for _, pid := range pids {
+			status.Kills++
+			status.LastKillPid = pid
+			status.LastKillTime = time.Now()
+			fmt.Printf("kill process %d by signal %s, kills: %d\n", pid, signalName(c.signal), status.Kills)
+		}
+		if len(pids) != 0 {
+			if err := util.SaveState(c.stateName(), &status); err != nil {
+				return err
+			}
+		}
+		if c.maxKills != 0 && status.Kills >= c.maxKills {
+			return nil
+		}
+
+		select {
+		case <-stopChan:
+			return nil
+		case <-durationChan:
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
+
+func (c *crashLoop) FaultRemove(_ []string) error {
+	if err := util.StopKeeper(c.stateName()); err != nil {
+		return fmt.Errorf("remove %s failed: %v", c.FaultType, err)
+	}
+	return util.RemoveState(c.stateName())
+}
+
+// FaultStatus 输出已经杀死目标进程的次数。
+func (c *crashLoop) FaultStatus(_ []string) error {
+	if !util.KeeperIsRunning(c.stateName()) {
+		return fmt.Errorf("%s fault is not running", c.FaultType)
+	}
+
+	var status crashLoopStatus
+	if err := util.LoadState(c.stateName(), &status); err != nil {
+		return err
+	}
+	fmt.Printf("kills: %d, elapsed: %s\n", status.Kills, time.Since(status.StartTime).Truncate(time.Second))
+	if status.Kills != 0 {
+		fmt.Printf("last kill: process %d at %s\n", status.LastKillPid, status.LastKillTime.Format(time.RFC3339))
+	}
+	return nil
+}
@@ -18,10 +18,19 @@ package process
 
 import (
 	"fmt"
+	"io/ioutil"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
 	"syscall"
+	"time"
 
 	"arsenal-os/internal/parse"
 	"arsenal-os/submodules"
+	"arsenal-os/util"
+
+	"golang.org/x/sys/unix"
 )
 
 func init() {
@@ -31,25 +40,207 @@ func init() {
 	submodules.Add(newFaultType.FaultType, &newFaultType)
 }
 
+const (
+	defaultGracePeriod = 10 * time.Second
+	// exitPollInterval 等待目标进程退出时的检查间隔。
+	exitPollInterval = 10 * time.Millisecond
+)
+
 type exitAbnormally struct {
-	FaultType string
-	flags     map[string]string
-	pid       int
+	FaultType   string
+	flags       map[string]string
+	pids        []int
+	signal      syscall.Signal
+	escalate    bool
+	gracePeriod time.Duration
+}
+
+// exitResult 目标进程的退出状态，无法ptrace目标进程时isKnown为false。
+type exitResult struct {
+	isKnown   bool
+	status    unix.WaitStatus
+	escalated bool
 }
 
 func (e *exitAbnormally) Prepare(inputArgs []string) error {
 	e.flags = parse.TransInputFlagsToMap(inputArgs)
-	pid, err := GetProcessPidAndExistCheck(e.flags)
+	if inputArgs[submodules.OpsTypeIndex] == submodules.Remove {
+		return nil
+	}
+	pids, err := util.GetTargetProcesses(e.flags)
 	if err != nil {
 		return err
 	}
-	e.pid = pid
+	e.pids = pids
+
+	e.signal = syscall.SIGKILL
+	if signalStr, ok := e.flags["signal"]; ok {
+		if e.signal, err = parseSignal(signalStr); err != nil {
+			return err
+		}
+	}
+	if e.escalate, err = parse.GetBoolFlag(e.flags, "escalate"); err != nil {
+		return err
+	}
+	e.gracePeriod = defaultGracePeriod
+	if gracePeriodStr, ok := e.flags["grace-period"]; ok {
+		gracePeriod, err := strconv.Atoi(gracePeriodStr)
+		if err != nil || gracePeriod <= 0 {
+			return fmt.Errorf("grace-period param(%s) must be a positive integer", gracePeriodStr)
+		}
+		e.gracePeriod = time.Duration(gracePeriod) * time.Second
+	}
+	return nil
+}
+
+// processIsExited 判断进程是否已经退出，未被父进程回收的僵尸进程同样视为已退出。
+func processIsExited(pid int) bool {
+	data, err := ioutil.ReadFile(fmt.Sprintf("/proc/%d/stat", pid))
+	if err != nil {
+		return true
+	}
+	stat := string(data)
+	fields := strings.Fields(stat[strings.LastIndexByte(stat, ')')+1:])
+	return len(fields) == 0 || fields[0] == "Z" || fields[0] == "X"
+}
+
+// waitTraced 处理被ptrace的目标进程的停止事件，返回进程是否已经退出。
+func waitTraced(pid int, result *exitResult) (bool, error) {
+	var status unix.WaitStatus
+	wpid, err := unix.Wait4(pid, &status, unix.WNOHANG|unix.WALL, nil)
+	if err != nil {
+		return false, fmt.Errorf("wait process %d failed: %v", pid, err)
+	}
+	if wpid != pid {
+		return false, nil
+	}
+	if status.Exited() || status.Signaled() {
+		result.status = status
+		return true, nil
+	}
+	if !status.Stopped() {
+		return false, nil
+	}
+	// 组停止事件需要PTRACE_LISTEN保持进程停止，其余为信号投递停止，需要将信号重新注入进程。
+	if uint32(status)>>16 == unix.PTRACE_EVENT_STOP {
+		_, _, errno := unix.Syscall6(unix.SYS_PTRACE, unix.PTRACE_LISTEN, uintptr(pid), 0, 0, 0, 0)
+		if errno != 0 {
+			return false, fmt.Errorf("ptrace listen process %d failed: %v", pid, errno)
+		}
+		return false, nil
+	}
+	if err := unix.PtraceCont(pid, int(status.StopSignal())); err != nil {
+		return false, fmt.Errorf("ptrace continue process %d failed: %v", pid, err)
+	}
+	return false, nil
+}
+
+// detachTraced 目标进程未退出时停止跟踪，ptrace只能在进程停止时脱离。
+func detachTraced(pid int) {
+	if err := unix.PtraceInterrupt(pid); err != nil {
+		return
+	}
+	var status unix.WaitStatus
+	if _, err := unix.Wait4(pid, &status, unix.WALL, nil); err != nil {
+		return
+	}
+	unix.PtraceDetach(pid)
+}
+
+// killAndWait 向目标进程发送信号并等待退出，超过宽限期后按需升级为SIGKILL。
+// 目标进程不是当前进程的子进程，通过PTRACE_SEIZE跟踪主线程，主线程在整个线程组退出后才会被回收，
+// 因此可以获取进程的退出状态；不允许ptrace时轮询/proc/<pid>/stat等待退出。
+func (e *exitAbnormally) killAndWait(pid int) (*exitResult, error) {
+	// ptrace请求必须由同一个线程发出。
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+
+	result := exitResult{isKnown: unix.PtraceSeize(pid) == nil}
+	if err := syscall.Kill(pid, e.signal); err != nil {
+		if result.isKnown {
+			detachTraced(pid)
+		}
+		return nil, fmt.Errorf("send signal %s to process %d failed: %v", signalName(e.signal), pid, err)
+	}
+
+	deadline := time.Now().Add(e.gracePeriod)
+	for {
+		if result.isKnown {
+			isExited, err := waitTraced(pid, &result)
+			if err != nil {
+				return nil, err
+			}
+			if isExited {
+				return &result, nil
+			}
+		} else if processIsExited(pid) {
+			return &result, nil
+		}
+
+		if time.Now().After(deadline) {
+			if !e.escalate || result.escalated {
+				if result.isKnown {
+					detachTraced(pid)
+				}
+				return nil, fmt.Errorf("process %d did not exit in %s after signal %s",
+					pid, e.gracePeriod, signalName(e.signal))
+			}
+			if err := syscall.Kill(pid, syscall.SIGKILL); err != nil && err != syscall.ESRCH {
+				return nil, fmt.Errorf("send signal SIGKILL to process %d failed: %v", pid, err)
+			}
+			result.escalated = true
+			deadline = time.Now().Add(e.gracePeriod)
+		}
+		time.Sleep(exitPollInterval)
+	}
+}
+
+// verifyExit 检查进程是否被预期的信号杀死，并输出core文件的生成情况。
+func (e *exitAbnormally) verifyExit(pid int, result *exitResult, coreInfo *coreDumpInfo) error {
+	if !result.isKnown {
+		fmt.Printf("process %d exited, exit signal could not be confirmed because ptrace is not permitted\n", pid)
+		if coreFile, _ := coreInfo.findCoreFile(e.signal); coreFile != "" {
+			fmt.Printf("process %d: core file: %s\n", pid, coreFile)
+		}
+		return nil
+	}
+	if result.status.Exited() {
+		return fmt.Errorf("process %d exited with code %d, expect signal %s",
+			pid, result.status.ExitStatus(), signalName(e.signal))
+	}
+
+	signal := result.status.Signal()
+	fmt.Printf("process %d exited by signal %s\n", pid, signalName(signal))
+	coreInfo.report(signal, result.status.CoreDump())
+	if signal != e.signal && !(result.escalated && signal == syscall.SIGKILL) {
+		return fmt.Errorf("process %d exited by signal %s, expect signal %s",
+			pid, signalName(signal), signalName(e.signal))
+	}
 	return nil
 }
 
 func (e *exitAbnormally) FaultInject(_ []string) error {
-	if err := syscall.Kill(e.pid, syscall.SIGKILL); err != nil {
-		return fmt.Errorf("%s kill process: %d failed: %v", e.FaultType, e.pid, err)
+	var wg sync.WaitGroup
+	errs := make([]error, len(e.pids))
+	for index, pid := range e.pids {
+		wg.Add(1)
+		go func(index, pid int) {
+			defer wg.Done()
+			coreInfo := collectCoreDumpInfo(pid)
+			result, err := e.killAndWait(pid)
+			if err != nil {
+				errs[index] = err
+				return
+			}
+			errs[index] = e.verifyExit(pid, result, coreInfo)
+		}(index, pid)
+	}
+	wg.Wait()
+
+	for _, err := range errs {
+		if err != nil {
+			return fmt.Errorf("%s failed: %v", e.FaultType, err)
+		}
 	}
 	return nil
 }
@@ -0,0 +1,320 @@
+/*
+Copyright 2023 Sangfor Technologies Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package process
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"arsenal-os/internal/parse"
+	"arsenal-os/submodules"
+	"arsenal-os/util"
+)
+
+func init() {
+	var newFaultType = freeze{
+		FaultType: "process-freeze",
+	}
+	submodules.Add(newFaultType.FaultType, &newFaultType)
+}
+
+const (
+	// freezeTimeout 等待cgroup中所有任务进入冻结状态的超时时间，任务处于不可中断睡眠时冻结会延迟。
+	freezeTimeout      = 10 * time.Second
+	freezePollInterval = 50 * time.Millisecond
+	freezeCgroupPrefix = "arsenal-os-freeze-"
+)
+
+// freeze 通过cgroup freezer冻结目标进程，与SIGSTOP不同，被冻结的进程对父进程和调试器不可见，
+// 且cgroup中的所有进程(包括子进程)同时被冻结，更接近容器挂起的场景。
+type freeze struct {
+	FaultType string
+	flags     map[string]string
+	pids      []int
+	newCgroup bool
+	isV2      bool
+}
+
+// frozenCgroup 记录被冻结的cgroup，Origin不为空时表示cgroup是为目标进程新建的，
+// 清理时需要将Pids迁移回Origin并删除cgroup。
+type frozenCgroup struct {
+	Path   string
+	Origin string
+	Pids   []int
+}
+
+type freezeRecord struct {
+	IsV2    bool
+	Cgroups []frozenCgroup
+}
+
+func (f *freeze) stateName() string {
+	return util.SelectorStateName(f.FaultType, f.flags)
+}
+
+func (f *freeze) Prepare(inputArgs []string) error {
+	f.flags = parse.TransInputFlagsToMap(inputArgs)
+	f.isV2 = util.IsCgroupV2()
+	if inputArgs[submodules.OpsTypeIndex] == submodules.Remove {
+		return nil
+	}
+	if !f.isV2 && !util.FileIsExist(filepath.Join(util.CgroupRoot, "freezer")) {
+		return fmt.Errorf("can't found %s, freezer cgroup is not mounted", filepath.Join(util.CgroupRoot, "freezer"))
+	}
+
+	newCgroup, err := parse.GetBoolFlag(f.flags, "new-cgroup")
+	if err != nil {
+		return err
+	}
+	f.newCgroup = newCgroup
+	pids, err := util.GetTargetProcesses(f.flags)
+	if err != nil {
+		return err
+	}
+	f.pids = pids
+	return nil
+}
+
+func (f *freeze) rootCgroup() string {
+	if f.isV2 {
+		return util.CgroupRoot
+	}
+	return filepath.Join(util.CgroupRoot, "freezer")
+}
+
+// stateFile 返回freezer控制文件名和冻结、解冻时写入的值。
+func (f *freeze) stateFile() (string, string, string) {
+	if f.isV2 {
+		return "cgroup.freeze", "1", "0"
+	}
+	return "freezer.state", "FROZEN", "THAWED"
+}
+
+// isFrozen 判断cgroup是否已经完全冻结，cgroup v2通过cgroup.events中的frozen字段判断，
+// cgroup v1的freezer.state在冻结过程中为FREEZING。
+func (f *freeze) isFrozen(cgroupPath string) (bool, error) {
+	if !f.isV2 {
+		state, err := util.ReadCgroupFile(cgroupPath, "freezer.state")
+		return state == "FROZEN", err
+	}
+	events, err := util.ReadCgroupFile(cgroupPath, "cgroup.events")
+	if err != nil {
+		return false, err
+	}
+	for _, line := range strings.Split(events, "\n") {
+		if fields := strings.Fields(line); len(fields) == 2 && fields[0] == "frozen" {
+			return fields[1] == "1", nil
+		}
+	}
+	return false, fmt.Errorf("can't found frozen in %s/cgroup.events", cgroupPath)
+}
+
+// checkCgroup 拒绝冻结根cgroup和包含arsenal-os自身的cgroup，freezer是分层生效的，
+// 冻结祖先cgroup会导致arsenal-os无法执行清理。
+func (f *freeze) checkCgroup(cgroupPath string) error {
+	if cgroupPath == f.rootCgroup() {
+		return fmt.Errorf("refuse to freeze root cgroup %s, please use param new-cgroup", cgroupPath)
+	}
+	selfPath, err := util.GetProcessCgroupPath(os.Getpid(), "freezer")
+	if err != nil {
+		return err
+	}
+	if selfPath == cgroupPath || strings.HasPrefix(selfPath, cgroupPath+"/") {
+		return fmt.Errorf("refuse to freeze cgroup %s which contains arsenal-os itself", cgroupPath)
+	}
+	if frozen, err := f.isFrozen(cgroupPath); err != nil || frozen {
+		if err != nil {
+			return err
+		}
+		return fmt.Errorf("cgroup %s has already been frozen", cgroupPath)
+	}
+	return nil
+}
+
+// descendantPids 获取进程及其所有子孙进程，新建cgroup时一起迁移，与冻结整个cgroup的效果一致。
+func descendantPids(pid int) ([]int, error) {
+	procList, err := ioutil.ReadDir("/proc")
+	if err != nil {
+		return nil, fmt.Errorf("read /proc failed: %v", err)
+	}
+	children := make(map[int][]int)
+	for _, proc := range procList {
+		childPid, err := strconv.Atoi(proc.Name())
+		if err != nil {
+			continue
+		}
+		info, err := util.ReadProcessInfo(childPid)
+		if err != nil || info == nil {
+			continue
+		}
+		ppid, err := strconv.Atoi(info.Ppid)
+		if err != nil {
+			continue
+		}
+		children[ppid] = append(children[ppid], childPid)
+	}
+
+	pids := []int{pid}
+	for index := 0; index < len(pids); index++ {
+		pids = append(pids, children[pids[index]]...)
+	}
+	return pids, nil
+}
+
+// prepareCgroups 获取需要冻结的cgroup，指定--new-cgroup时在目标进程原cgroup下新建子cgroup并迁移目标进程。
+func (f *freeze) prepareCgroups(record *freezeRecord) error {
+	seen := make(map[string]bool)
+	for _, pid := range f.pids {
+		cgroupPath, err := util.GetProcessCgroupPath(pid, "freezer")
+		if err != nil {
+			return err
+		}
+		if !f.newCgroup {
+			if seen[cgroupPath] {
+				continue
+			}
+			seen[cgroupPath] = true
+			if err := f.checkCgroup(cgroupPath); err != nil {
+				return err
+			}
+			record.Cgroups = append(record.Cgroups, frozenCgroup{Path: cgroupPath})
+			continue
+		}
+
+		newPath := filepath.Join(cgroupPath, fmt.Sprintf("%s%d", freezeCgroupPrefix, pid))
+		if err := os.Mkdir(newPath, 0755); err != nil {
+			return fmt.Errorf("create cgroup %s failed: %v", newPath, err)
+		}
+		frozen := frozenCgroup{Path: newPath, Origin: cgroupPath}
+		pids, err := descendantPids(pid)
+		if err != nil {
+			return err
+		}
+		// 先记录新建的cgroup，迁移失败时清理流程仍能将已迁移的进程移回。
+		record.Cgroups = append(record.Cgroups, frozen)
+		for _, movePid := range pids {
+			// 目标进程是arsenal-os的祖先进程时不能迁移arsenal-os自身。
+			if movePid == os.Getpid() {
+				continue
+			}
+			if err := util.MoveProcessToCgroup(movePid, newPath); err != nil {
+				if !util.ProcessIsExist(movePid) {
+					continue
+				}
+				return err
+			}
+			record.Cgroups[len(record.Cgroups)-1].Pids = append(record.Cgroups[len(record.Cgroups)-1].Pids, movePid)
+		}
+	}
+	return nil
+}
+
+// waitFrozen 等待cgroup冻结完成。
+func (f *freeze) waitFrozen(cgroupPath string) error {
+	deadline := time.Now().Add(freezeTimeout)
+	for time.Now().Before(deadline) {
+		if frozen, err := f.isFrozen(cgroupPath); err != nil || frozen {
+			return err
+		}
+		time.Sleep(freezePollInterval)
+	}
+	return fmt.Errorf("wait cgroup %s frozen timeout", cgroupPath)
+}
+
+func (f *freeze) FaultInject(_ []string) error {
+	if util.StateIsExist(f.stateName()) {
+		return fmt.Errorf("%s fault has been injected", f.FaultType)
+	}
+	record := freezeRecord{IsV2: f.isV2}
+	defer func() {
+		if len(record.Cgroups) != 0 {
+			util.SaveState(f.stateName(), &record)
+		}
+	}()
+	if err := f.prepareCgroups(&record); err != nil {
+		return err
+	}
+
+	name, frozenValue, _ := f.stateFile()
+	for _, cgroup := range record.Cgroups {
+		if err := util.WriteCgroupFile(cgroup.Path, name, frozenValue); err != nil {
+			return err
+		}
+		if err := f.waitFrozen(cgroup.Path); err != nil {
+			return err
+		}
+		fmt.Printf("freeze cgroup: %s\n", cgroup.Path)
+	}
+	return nil
+}
+
+// restoreCgroup 将进程迁移回原cgroup并删除新建的cgroup，进程可能已经退出或被其他程序迁移。
+func restoreCgroup(cgroup *frozenCgroup) error {
+	for _, pid := range cgroup.Pids {
+		if err := util.MoveProcessToCgroup(pid, cgroup.Origin); err != nil && util.ProcessIsExist(pid) {
+			return err
+		}
+	}
+	// 删除cgroup需要等待其中的进程完全迁出或退出。
+	deadline := time.Now().Add(freezeTimeout)
+	for {
+		err := syscall.Rmdir(cgroup.Path)
+		if err == nil || err == syscall.ENOENT {
+			return nil
+		}
+		if err != syscall.EBUSY || time.Now().After(deadline) {
+			return fmt.Errorf("remove cgroup %s failed: %v", cgroup.Path, err)
+		}
+		time.Sleep(freezePollInterval)
+	}
+}
+
+func (f *freeze) FaultRemove(_ []string) error {
+	if !util.StateIsExist(f.stateName()) {
+		return nil
+	}
+	var record freezeRecord
+	if err := util.LoadState(f.stateName(), &record); err != nil {
+		return err
+	}
+	f.isV2 = record.IsV2
+
+	name, _, thawedValue := f.stateFile()
+	for index := range record.Cgroups {
+		cgroup := &record.Cgroups[index]
+		// 容器退出后cgroup目录可能已经被删除。
+		if !util.FileIsExist(cgroup.Path) {
+			continue
+		}
+		if err := util.WriteCgroupFile(cgroup.Path, name, thawedValue); err != nil {
+			return err
+		}
+		if cgroup.Origin == "" {
+			continue
+		}
+		if err := restoreCgroup(cgroup); err != nil {
+			return err
+		}
+	}
+	return util.RemoveState(f.stateName())
+}
@@ -22,6 +22,7 @@ import (
 
 	"arsenal-os/internal/parse"
 	"arsenal-os/submodules"
+	"arsenal-os/util"
 )
 
 func init() {
@@ -34,29 +35,64 @@ func init() {
 type hang struct {
 	FaultType string
 	flags     map[string]string
-	pid       int
+	pids      []int
+}
+
+// hangTargets 记录被暂停的进程，选择器每次选择的结果可能不同，清理时以记录为准。
+type hangTargets struct {
+	Pids []int
+}
+
+func (h *hang) stateName() string {
+	return util.SelectorStateName(h.FaultType, h.flags)
 }
 
 func (h *hang) Prepare(inputArgs []string) error {
 	h.flags = parse.TransInputFlagsToMap(inputArgs)
-	pid, err := GetProcessPidAndExistCheck(h.flags)
+	if inputArgs[submodules.OpsTypeIndex] == submodules.Remove && util.StateIsExist(h.stateName()) {
+		return nil
+	}
+	pids, err := util.GetTargetProcesses(h.flags)
 	if err != nil {
 		return err
 	}
-	h.pid = pid
+	h.pids = pids
 	return nil
 }
 
 func (h *hang) FaultInject(_ []string) error {
-	if err := syscall.Kill(h.pid, syscall.SIGSTOP); err != nil {
-		return fmt.Errorf("stop process: %d failed: %v", h.pid, err)
+	if util.StateIsExist(h.stateName()) {
+		return fmt.Errorf("%s fault has been injected", h.FaultType)
+	}
+	var targets hangTargets
+	defer func() {
+		if len(targets.Pids) != 0 {
+			util.SaveState(h.stateName(), &targets)
+		}
+	}()
+	for _, pid := range h.pids {
+		if err := syscall.Kill(pid, syscall.SIGSTOP); err != nil {
+			return fmt.Errorf("stop process: %d failed: %v", pid, err)
+		}
+		targets.Pids = append(targets.Pids, pid)
 	}
+	fmt.Printf("stop process: %v\n", targets.Pids)
 	return nil
 }
 
 func (h *hang) FaultRemove(_ []string) error {
-	if err := syscall.Kill(h.pid, syscall.SIGCONT); err != nil {
-		return fmt.Errorf("run process %d failed: %v", h.pid, err)
+	// 没有注入记录时兼容直接指定--pid的清理方式。
+	if util.StateIsExist(h.stateName()) {
+		var targets hangTargets
+		if err := util.LoadState(h.stateName(), &targets); err != nil {
+			return err
+		}
+		h.pids = targets.Pids
 	}
-	return nil
+	for _, pid := range h.pids {
+		if err := syscall.Kill(pid, syscall.SIGCONT); err != nil && err != syscall.ESRCH {
+			return fmt.Errorf("run process %d failed: %v", pid, err)
+		}
+	}
+	return util.RemoveState(h.stateName())
 }
@@ -0,0 +1,198 @@
+/*
+Copyright 2023 Sangfor Technologies Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package process
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+
+	"arsenal-os/internal/parse"
+	"arsenal-os/submodules"
+	"arsenal-os/util"
+)
+
+func init() {
+	var newFaultType = memoryLimit{
+		FaultType: "process-memory-limit",
+	}
+	submodules.Add(newFaultType.FaultType, &newFaultType)
+}
+
+var validMemoryLimitKnobs = map[string][]string{
+	"max":  {"memory.max"},
+	"high": {"memory.high"},
+	"both": {"memory.high", "memory.max"},
+}
+
+type memoryLimit struct {
+	FaultType  string
+	flags      map[string]string
+	pid        int
+	cgroupPath string
+	isV2       bool
+	limit      uint64
+	knobs      []string
+}
+
+// memoryLimitBackup 记录被修改的cgroup目录和各控制文件的原始值。
+type memoryLimitBackup struct {
+	CgroupPath string
+	Limits     map[string]string
+}
+
+func (m *memoryLimit) stateName() string {
+	return fmt.Sprintf("%s-%d", m.FaultType, m.pid)
+}
+
+func (m *memoryLimit) usageFileName() string {
+	if m.isV2 {
+		return "memory.current"
+	}
+	return "memory.usage_in_bytes"
+}
+
+func (m *memoryLimit) knobParser() error {
+	// cgroup v1只有memory.limit_in_bytes一个硬限制。
+	if !m.isV2 {
+		m.knobs = []string{"memory.limit_in_bytes"}
+		return nil
+	}
+	knob := "max"
+	if value, ok := m.flags["knob"]; ok {
+		knob = value
+	}
+	knobs, ok := validMemoryLimitKnobs[knob]
+	if !ok {
+		return fmt.Errorf("invalid knob param: %s, example: max, high, both", knob)
+	}
+	m.knobs = knobs
+	return nil
+}
+
+// limitParser 计算新的内存限制，--limit直接指定大小，--percent为当前内存使用量的百分比。
+func (m *memoryLimit) limitParser() error {
+	if limitStr, ok := m.flags["limit"]; ok {
+		limit, err := util.ParseSize(limitStr)
+		if err != nil {
+			return fmt.Errorf("limit param error: %v", err)
+		}
+		m.limit = limit
+	} else if percentStr, ok := m.flags["percent"]; ok {
+		percent, err := strconv.ParseFloat(percentStr, 64)
+		if err != nil || percent <= 0 || percent > 100 {
+			return fmt.Errorf("percent param(%s) must be in range (0, 100]", percentStr)
+		}
+		usageStr, err := util.ReadCgroupFile(m.cgroupPath, m.usageFileName())
+		if err != nil {
+			return err
+		}
+		usage, err := strconv.ParseUint(usageStr, 10, 64)
+		if err != nil {
+			return fmt.Errorf("trans memory usage(%s) to int failed: %v", usageStr, err)
+		}
+		m.limit = uint64(float64(usage) * percent / 100)
+	} else {
+		return errors.New("please input param limit or percent")
+	}
+
+	if m.limit == 0 {
+		return errors.New("memory limit must be larger than 0")
+	}
+	return nil
+}
+
+func (m *memoryLimit) Prepare(inputArgs []string) error {
+	m.flags = parse.TransInputFlagsToMap(inputArgs)
+	// 清理时目标进程可能已经被OOM kill，只需要pid用于查找注入记录。
+	pid, err := util.GetProcessPidAndExistCheck(m.flags)
+	if err != nil && (pid < 0 || inputArgs[submodules.OpsTypeIndex] != submodules.Remove) {
+		return err
+	}
+	m.pid = pid
+	if inputArgs[submodules.OpsTypeIndex] == submodules.Remove {
+		return nil
+	}
+
+	m.isV2 = util.IsCgroupV2()
+	cgroupPath, err := util.GetProcessCgroupPath(m.pid, "memory")
+	if err != nil {
+		return err
+	}
+	if cgroupPath == util.CgroupRoot || cgroupPath == util.CgroupRoot+"/memory" {
+		return fmt.Errorf("process %d is in root cgroup which has no memory limit", m.pid)
+	}
+	m.cgroupPath = cgroupPath
+
+	if err := m.knobParser(); err != nil {
+		return err
+	}
+	return m.limitParser()
+}
+
+func (m *memoryLimit) FaultInject(_ []string) error {
+	if util.StateIsExist(m.stateName()) {
+		return fmt.Errorf("process %d has been injected %s fault", m.pid, m.FaultType)
+	}
+
+	backup := memoryLimitBackup{
+		CgroupPath: m.cgroupPath,
+		Limits:     make(map[string]string, len(m.knobs)),
+	}
+	for _, knob := range m.knobs {
+		value, err := util.ReadCgroupFile(m.cgroupPath, knob)
+		if err != nil {
+			return err
+		}
+		backup.Limits[knob] = value
+	}
+	if err := util.SaveState(m.stateName(), &backup); err != nil {
+		return err
+	}
+
+	// 先写memory.high再写memory.max，使进程先进入回收抑制再达到硬限制。
+	limitStr := strconv.FormatUint(m.limit, 10)
+	for _, knob := range m.knobs {
+		if err := util.WriteCgroupFile(m.cgroupPath, knob, limitStr); err != nil {
+			return err
+		}
+	}
+	fmt.Printf("set %s memory limit to %s\n", m.cgroupPath, util.FormatSize(m.limit))
+	return nil
+}
+
+func (m *memoryLimit) FaultRemove(_ []string) error {
+	var backup memoryLimitBackup
+	if err := util.LoadState(m.stateName(), &backup); err != nil {
+		return fmt.Errorf("%s load raw memory limit failed: %v", m.FaultType, err)
+	}
+
+	// 容器被OOM kill后cgroup目录可能已经被删除。
+	if util.FileIsExist(backup.CgroupPath) {
+		// 与注入顺序相反，先放开硬限制再恢复memory.high。
+		for _, knob := range []string{"memory.max", "memory.high", "memory.limit_in_bytes"} {
+			value, ok := backup.Limits[knob]
+			if !ok {
+				continue
+			}
+			if err := util.WriteCgroupFile(backup.CgroupPath, knob, value); err != nil {
+				return err
+			}
+		}
+	}
+	return util.RemoveState(m.stateName())
+}
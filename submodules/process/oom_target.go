@@ -0,0 +1,309 @@
+/*
+Copyright 2023 Sangfor Technologies Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package process
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"arsenal-os/internal/parse"
+	"arsenal-os/submodules"
+	"arsenal-os/util"
+
+	"golang.org/x/sys/unix"
+)
+
+func init() {
+	var newFaultType = oomTarget{
+		FaultType: "process-oom-target",
+	}
+	submodules.Add(newFaultType.FaultType, &newFaultType)
+}
+
+const (
+	oomScoreAdjMin = -1000
+	oomScoreAdjMax = 1000
+	// oomPressureTimeout pressure模式下等待目标进程被OOM killer杀死的默认超时时间，单位：秒。
+	oomPressureTimeout = 60
+	// oomPressureInterval pressure模式下每次申请内存的间隔，给OOM killer留出选择和杀死进程的时间。
+	oomPressureInterval = 10 * time.Millisecond
+	// oomExitWaitTime 触发OOM killer后等待目标进程退出的时间。
+	oomExitWaitTime = time.Second
+	vmstatPath      = "/proc/vmstat"
+)
+
+var (
+	oomRoleScores    = map[string]int{"victim": oomScoreAdjMax, "protect": oomScoreAdjMin}
+	validOomTriggers = []string{"none", "sysrq", "pressure"}
+)
+
+// oomTarget 修改目标进程的oom_score_adj，使OOM killer优先杀死或者不杀死目标进程，
+// 再按需通过sysrq f或申请内存触发OOM killer。
+type oomTarget struct {
+	FaultType string
+	flags     map[string]string
+	pids      []int
+	score     int
+	trigger   string
+	timeout   time.Duration
+}
+
+// processOomScore 目标进程原始的oom_score_adj，StartTime用于清理时识别pid是否被复用。
+type processOomScore struct {
+	StartTime uint64
+	Score     string
+}
+
+// oomScoreBackup 记录目标进程原始的oom_score_adj，key为pid。
+type oomScoreBackup struct {
+	Scores map[int]processOomScore
+}
+
+func (o *oomTarget) stateName() string {
+	return util.SelectorStateName(o.FaultType, o.flags)
+}
+
+func oomScoreAdjPath(pid int) string {
+	return fmt.Sprintf("/proc/%d/oom_score_adj", pid)
+}
+
+func (o *oomTarget) scoreParser() error {
+	role, hasRole := o.flags["role"]
+	scoreStr, hasScore := o.flags["score"]
+	switch {
+	case hasRole && hasScore:
+		return errors.New("param role and score can not be used together")
+	case hasRole:
+		score, ok := oomRoleScores[role]
+		if !ok {
+			return fmt.Errorf("invalid role %s, example: victim, protect", role)
+		}
+		o.score = score
+	case hasScore:
+		score, err := strconv.Atoi(scoreStr)
+		if err != nil || score < oomScoreAdjMin || score > oomScoreAdjMax {
+			return fmt.Errorf("score param(%s) must be in range [%d, %d]", scoreStr, oomScoreAdjMin, oomScoreAdjMax)
+		}
+		o.score = score
+	default:
+		return errors.New("please input param role or score")
+	}
+	return nil
+}
+
+func (o *oomTarget) Prepare(inputArgs []string) error {
+	o.flags = parse.TransInputFlagsToMap(inputArgs)
+	if inputArgs[submodules.OpsTypeIndex] == submodules.Remove {
+		return nil
+	}
+	if err := o.scoreParser(); err != nil {
+		return err
+	}
+
+	o.trigger = "none"
+	if trigger, ok := o.flags["trigger"]; ok {
+		o.trigger = trigger
+	}
+	if !util.IsValidValue(o.trigger, validOomTriggers) {
+		return fmt.Errorf("invalid trigger %s, example: %s", o.trigger, validOomTriggers)
+	}
+	if o.trigger == "sysrq" && !util.FileIsExist(util.SysrqTriggerPath) {
+		return fmt.Errorf("can't found file: %s", util.SysrqTriggerPath)
+	}
+	// 目标进程不是优先被杀死的进程时，持续申请内存可能导致其他进程甚至arsenal-os自身被杀死。
+	if o.trigger == "pressure" && o.score <= 0 {
+		return errors.New("pressure trigger requires a positive score, please use role victim")
+	}
+	// pressure模式需要将arsenal-os自身的oom_score_adj设置为-1000。
+	if o.trigger == "pressure" && !util.HasCapability(unix.CAP_SYS_RESOURCE) {
+		return errors.New("pressure trigger requires CAP_SYS_RESOURCE capability")
+	}
+	o.timeout = oomPressureTimeout * time.Second
+	if timeoutStr, ok := o.flags["timeout"]; ok {
+		timeout, err := strconv.Atoi(timeoutStr)
+		if err != nil || timeout <= 0 {
+			return fmt.Errorf("timeout param(%s) must be a positive integer", timeoutStr)
+		}
+		o.timeout = time.Duration(timeout) * time.Second
+	}
+
+	pids, err := util.GetTargetProcesses(o.flags)
+	if err != nil {
+		return err
+	}
+	o.pids = pids
+	return nil
+}
+
+// anyTargetExited 返回第一个已经退出的目标进程，没有时返回-1。
+func (o *oomTarget) anyTargetExited() int {
+	for _, pid := range o.pids {
+		if processIsExited(pid) {
+			return pid
+		}
+	}
+	return -1
+}
+
+func (o *oomTarget) triggerSysrq() error {
+	if result, err := util.ExecCommandBlock(fmt.Sprintf("echo f > %s", util.SysrqTriggerPath)); err != nil {
+		return fmt.Errorf("trigger oom killer failed, err: %v, result: %s", err, result)
+	}
+	time.Sleep(oomExitWaitTime)
+	return nil
+}
+
+// oomKillCount 读取/proc/vmstat中OOM killer杀死进程的累计次数。
+func oomKillCount() (uint64, error) {
+	data, err := ioutil.ReadFile(vmstatPath)
+	if err != nil {
+		return 0, fmt.Errorf("read %s failed: %v", vmstatPath, err)
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		if fields := strings.Fields(line); len(fields) == 2 && fields[0] == "oom_kill" {
+			return strconv.ParseUint(fields[1], 10, 64)
+		}
+	}
+	return 0, fmt.Errorf("can't found oom_kill in %s", vmstatPath)
+}
+
+// triggerPressure 持续申请匿名内存直到OOM killer杀死进程或超时，OOM killer杀死进程后立即释放内存，
+// 避免被杀死的进程退出前继续申请内存导致更多进程被杀死。
+func (o *oomTarget) triggerPressure() error {
+	// arsenal-os是增长最快的内存占用者，禁止OOM killer选择自身，避免先于目标进程被杀死。
+	selfScorePath := oomScoreAdjPath(os.Getpid())
+	if err := ioutil.WriteFile(selfScorePath, []byte(strconv.Itoa(oomScoreAdjMin)), 0); err != nil {
+		return fmt.Errorf("write %d to %s failed: %v", oomScoreAdjMin, selfScorePath, err)
+	}
+	startCount, err := oomKillCount()
+	if err != nil {
+		return err
+	}
+	var memory util.AnonMemory
+	defer memory.Release()
+	deadline := time.Now().Add(o.timeout)
+	for {
+		if time.Now().After(deadline) {
+			return fmt.Errorf("oom killer is not triggered in %v, allocated %s", o.timeout, util.FormatSize(memory.Size()))
+		}
+		count, err := oomKillCount()
+		if err != nil {
+			return err
+		}
+		if count != startCount || o.anyTargetExited() >= 0 {
+			break
+		}
+		if err := memory.Grow(util.DefaultMemoryChunkSize); err != nil {
+			fmt.Printf("%s grow memory failed: %v\n", o.FaultType, err)
+		}
+		time.Sleep(oomPressureInterval)
+	}
+	fmt.Printf("oom killer is triggered after allocating %s\n", util.FormatSize(memory.Size()))
+	memory.Release()
+
+	// 被杀死的进程释放内存需要一定时间。
+	for exitDeadline := time.Now().Add(oomExitWaitTime); time.Now().Before(exitDeadline); {
+		if o.anyTargetExited() >= 0 {
+			break
+		}
+		time.Sleep(oomPressureInterval)
+	}
+	return nil
+}
+
+// setScores 修改目标进程的oom_score_adj并记录原始值。
+func (o *oomTarget) setScores(backup *oomScoreBackup) error {
+	scoreStr := strconv.Itoa(o.score)
+	for _, pid := range o.pids {
+		startTime, err := util.GetProcessStartTime(pid)
+		if err != nil {
+			return err
+		}
+		data, err := ioutil.ReadFile(oomScoreAdjPath(pid))
+		if err != nil {
+			return fmt.Errorf("read %s failed: %v", oomScoreAdjPath(pid), err)
+		}
+		// 降低oom_score_adj到低于进程的oom_score_adj_min时需要CAP_SYS_RESOURCE能力。
+		if err := ioutil.WriteFile(oomScoreAdjPath(pid), []byte(scoreStr), 0); err != nil {
+			return fmt.Errorf("write %s to %s failed: %v", scoreStr, oomScoreAdjPath(pid), err)
+		}
+		backup.Scores[pid] = processOomScore{StartTime: startTime, Score: strings.TrimSpace(string(data))}
+	}
+	return nil
+}
+
+func (o *oomTarget) FaultInject(_ []string) error {
+	if util.StateIsExist(o.stateName()) {
+		return fmt.Errorf("%s fault has been injected", o.FaultType)
+	}
+	// 触发OOM时arsenal-os自身也可能被杀死，触发前先保存原始值。
+	backup := oomScoreBackup{Scores: make(map[int]processOomScore)}
+	err := o.setScores(&backup)
+	if len(backup.Scores) != 0 {
+		if err := util.SaveState(o.stateName(), &backup); err != nil {
+			return err
+		}
+	}
+	if err != nil {
+		return err
+	}
+	fmt.Printf("set oom_score_adj of process %v to %d\n", o.pids, o.score)
+
+	switch o.trigger {
+	case "sysrq":
+		if err := o.triggerSysrq(); err != nil {
+			return err
+		}
+	case "pressure":
+		if err := o.triggerPressure(); err != nil {
+			return err
+		}
+	default:
+		return nil
+	}
+	if pid := o.anyTargetExited(); pid >= 0 {
+		fmt.Printf("target process %d is killed by oom killer\n", pid)
+	} else {
+		fmt.Printf("no target process is killed by oom killer\n")
+	}
+	return nil
+}
+
+func (o *oomTarget) FaultRemove(_ []string) error {
+	if !util.StateIsExist(o.stateName()) {
+		return nil
+	}
+	var backup oomScoreBackup
+	if err := util.LoadState(o.stateName(), &backup); err != nil {
+		return err
+	}
+	for pid, old := range backup.Scores {
+		// 目标进程可能已经被OOM killer杀死，或pid已经被重启后的其他进程复用。
+		if startTime, err := util.GetProcessStartTime(pid); err != nil || startTime != old.StartTime || processIsExited(pid) {
+			continue
+		}
+		if err := ioutil.WriteFile(oomScoreAdjPath(pid), []byte(old.Score), 0); err != nil {
+			return fmt.Errorf("write %s to %s failed: %v", old.Score, oomScoreAdjPath(pid), err)
+		}
+	}
+	return util.RemoveState(o.stateName())
+}
@@ -0,0 +1,352 @@
+/*
+Copyright 2023 Sangfor Technologies Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package process
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"unsafe"
+
+	"arsenal-os/internal/parse"
+	"arsenal-os/submodules"
+	"arsenal-os/util"
+
+	"golang.org/x/sys/unix"
+)
+
+func init() {
+	var newFaultType = priority{
+		FaultType: "process-priority",
+	}
+	submodules.Add(newFaultType.FaultType, &newFaultType)
+}
+
+// 调度策略和io优先级常量，定义见include/uapi/linux/sched.h和include/uapi/linux/ioprio.h。
+const (
+	schedOther       = 0
+	schedBatch       = 3
+	schedIdle        = 5
+	schedResetOnFork = 0x40000000
+
+	ioprioWhoProcess = 1
+	ioprioClassShift = 13
+	ioprioClassNone  = 0
+	ioprioClassBE    = 2
+	ioprioClassIdle  = 3
+	ioprioMaxLevel   = 7
+
+	minNice = -20
+	maxNice = 19
+)
+
+var (
+	schedPolicies = map[string]int{"other": schedOther, "batch": schedBatch, "idle": schedIdle}
+	ioClasses     = map[string]int{"best-effort": ioprioClassBE, "idle": ioprioClassIdle}
+)
+
+// priority 修改目标进程所有线程的nice值、调度策略和io优先级，nice值、调度策略和io优先级都是线程级别的属性。
+type priority struct {
+	FaultType string
+	flags     map[string]string
+	pids      []int
+	nice      *int
+	policy    *int
+	ioprio    *int
+}
+
+// threadPriority 线程原始的调度属性。
+type threadPriority struct {
+	Nice        int
+	Policy      int
+	RTPriority  int
+	IOPriority  int
+	ResetOnFork bool
+}
+
+// priorityBackup 记录被修改的属性和各线程的原始值，key为tid，
+// StartTimes记录目标进程的启动时间，key为pid，用于清理时识别pid是否被复用。
+type priorityBackup struct {
+	SetNice    bool
+	SetPolicy  bool
+	SetIOPrio  bool
+	StartTimes map[int]uint64
+	Threads    map[int]threadPriority
+}
+
+// schedParam 对应内核的struct sched_param。
+type schedParam struct {
+	priority int32
+}
+
+func (p *priority) stateName() string {
+	return util.SelectorStateName(p.FaultType, p.flags)
+}
+
+func (p *priority) niceParser() error {
+	niceStr, ok := p.flags["nice"]
+	if !ok {
+		return nil
+	}
+	nice, err := strconv.Atoi(niceStr)
+	if err != nil || nice < minNice || nice > maxNice {
+		return fmt.Errorf("nice param(%s) must be in range [%d, %d]", niceStr, minNice, maxNice)
+	}
+	p.nice = &nice
+	return nil
+}
+
+func (p *priority) policyParser() error {
+	policyStr, ok := p.flags["policy"]
+	if !ok {
+		return nil
+	}
+	policy, ok := schedPolicies[policyStr]
+	if !ok {
+		return fmt.Errorf("invalid policy %s, example: idle, batch, other", policyStr)
+	}
+	p.policy = &policy
+	return nil
+}
+
+func (p *priority) ioprioParser() error {
+	classStr, ok := p.flags["io-class"]
+	if !ok {
+		if _, ok := p.flags["io-level"]; ok {
+			return errors.New("please input param io-class")
+		}
+		return nil
+	}
+	class, ok := ioClasses[classStr]
+	if !ok {
+		return fmt.Errorf("invalid io-class %s, example: idle, best-effort", classStr)
+	}
+	// idle类没有优先级级别，best-effort类默认使用最低的级别7。
+	level := ioprioMaxLevel
+	if levelStr, ok := p.flags["io-level"]; ok {
+		if class == ioprioClassIdle {
+			return errors.New("io-level is only valid for io-class best-effort")
+		}
+		var err error
+		if level, err = strconv.Atoi(levelStr); err != nil || level < 0 || level > ioprioMaxLevel {
+			return fmt.Errorf("io-level param(%s) must be in range [0, %d]", levelStr, ioprioMaxLevel)
+		}
+	}
+	if class == ioprioClassIdle {
+		level = 0
+	}
+	ioprio := class<<ioprioClassShift | level
+	p.ioprio = &ioprio
+	return nil
+}
+
+func (p *priority) Prepare(inputArgs []string) error {
+	p.flags = parse.TransInputFlagsToMap(inputArgs)
+	if inputArgs[submodules.OpsTypeIndex] == submodules.Remove {
+		return nil
+	}
+	if err := p.niceParser(); err != nil {
+		return err
+	}
+	if err := p.policyParser(); err != nil {
+		return err
+	}
+	if err := p.ioprioParser(); err != nil {
+		return err
+	}
+	if p.nice == nil && p.policy == nil && p.ioprio == nil {
+		return errors.New("please input params: nice, policy or io-class")
+	}
+
+	pids, err := util.GetTargetProcesses(p.flags)
+	if err != nil {
+		return err
+	}
+	p.pids = pids
+	return nil
+}
+
+// getThreadPriority 获取线程的调度属性，getpriority系统调用返回20-nice。
+// 返回原始的错误码，调用者据此判断线程是否已经退出。
+func getThreadPriority(tid int) (*threadPriority, error) {
+	value, err := unix.Getpriority(unix.PRIO_PROCESS, tid)
+	if err != nil {
+		return nil, err
+	}
+	thread := threadPriority{Nice: 20 - value}
+
+	policy, _, errno := unix.Syscall(unix.SYS_SCHED_GETSCHEDULER, uintptr(tid), 0, 0)
+	if errno != 0 {
+		return nil, errno
+	}
+	thread.Policy = int(policy) &^ schedResetOnFork
+	thread.ResetOnFork = int(policy)&schedResetOnFork != 0
+	var param schedParam
+	if _, _, errno := unix.Syscall(unix.SYS_SCHED_GETPARAM, uintptr(tid), uintptr(unsafe.Pointer(&param)), 0); errno != 0 {
+		return nil, errno
+	}
+	thread.RTPriority = int(param.priority)
+
+	ioprio, _, errno := unix.Syscall(unix.SYS_IOPRIO_GET, ioprioWhoProcess, uintptr(tid), 0)
+	if errno != 0 {
+		return nil, errno
+	}
+	// 5.17之前的内核对没有io_context的线程返回NONE类别并附带由nice值换算的等级，
+	// ioprio_set不接受带等级的NONE类别，按不带等级的NONE保存。
+	if int(ioprio)>>ioprioClassShift == ioprioClassNone {
+		ioprio = 0
+	}
+	thread.IOPriority = int(ioprio)
+	return &thread, nil
+}
+
+func setThreadScheduler(tid, policy, rtPriority int) error {
+	param := schedParam{priority: int32(rtPriority)}
+	if _, _, errno := unix.Syscall(unix.SYS_SCHED_SETSCHEDULER, uintptr(tid), uintptr(policy),
+		uintptr(unsafe.Pointer(&param))); errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+func setThreadIOPriority(tid, ioprio int) error {
+	if _, _, errno := unix.Syscall(unix.SYS_IOPRIO_SET, ioprioWhoProcess, uintptr(tid), uintptr(ioprio)); errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+func setThreadNice(tid, nice int) error {
+	return unix.Setpriority(unix.PRIO_PROCESS, tid, nice)
+}
+
+// setThreadPriority 按照backup中记录的需要修改的属性设置线程的调度属性，返回原始的错误码，
+// 恢复时先恢复调度策略，SCHED_IDLE线程的nice值在切换回普通策略后才会生效。
+func setThreadPriority(tid int, backup *priorityBackup, thread *threadPriority) error {
+	if backup.SetPolicy {
+		policy := thread.Policy
+		if thread.ResetOnFork {
+			policy |= schedResetOnFork
+		}
+		if err := setThreadScheduler(tid, policy, thread.RTPriority); err != nil {
+			return err
+		}
+	}
+	if backup.SetNice {
+		if err := setThreadNice(tid, thread.Nice); err != nil {
+			return err
+		}
+	}
+	if backup.SetIOPrio {
+		if err := setThreadIOPriority(tid, thread.IOPriority); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (p *priority) FaultInject(_ []string) error {
+	if util.StateIsExist(p.stateName()) {
+		return fmt.Errorf("%s fault has been injected", p.FaultType)
+	}
+
+	// 先保存所有线程的原始属性，再做修改，保证清理时可以完整恢复。
+	backup := priorityBackup{
+		SetNice:    p.nice != nil,
+		SetPolicy:  p.policy != nil,
+		SetIOPrio:  p.ioprio != nil,
+		StartTimes: make(map[int]uint64, len(p.pids)),
+		Threads:    make(map[int]threadPriority),
+	}
+	for _, pid := range p.pids {
+		startTime, err := util.GetProcessStartTime(pid)
+		if err != nil {
+			return err
+		}
+		backup.StartTimes[pid] = startTime
+		tids, err := util.GetProcessThreadIDs(pid)
+		if err != nil {
+			return fmt.Errorf("get process %d threads failed: %v", pid, err)
+		}
+		for _, tid := range tids {
+			thread, err := getThreadPriority(tid)
+			if err != nil {
+				// 线程可能在遍历过程中退出。
+				if err == unix.ESRCH {
+					continue
+				}
+				return fmt.Errorf("get thread %d priority failed: %v", tid, err)
+			}
+			backup.Threads[tid] = *thread
+		}
+	}
+	if err := util.SaveState(p.stateName(), &backup); err != nil {
+		return err
+	}
+
+	for tid, thread := range backup.Threads {
+		if p.policy != nil {
+			// 普通调度策略的实时优先级必须为0。
+			thread.Policy, thread.RTPriority, thread.ResetOnFork = *p.policy, 0, false
+		}
+		if p.nice != nil {
+			thread.Nice = *p.nice
+		}
+		if p.ioprio != nil {
+			thread.IOPriority = *p.ioprio
+		}
+		if err := setThreadPriority(tid, &backup, &thread); err != nil && err != unix.ESRCH {
+			return fmt.Errorf("set thread %d priority failed: %v", tid, err)
+		}
+	}
+	fmt.Printf("change priority of process %v, %d threads\n", p.pids, len(backup.Threads))
+	return nil
+}
+
+func (p *priority) FaultRemove(_ []string) error {
+	if !util.StateIsExist(p.stateName()) {
+		return nil
+	}
+	var backup priorityBackup
+	if err := util.LoadState(p.stateName(), &backup); err != nil {
+		return err
+	}
+
+	for pid, recordTime := range backup.StartTimes {
+		// 目标进程可能已经退出，或pid已经被重启后的其他进程复用。
+		if startTime, err := util.GetProcessStartTime(pid); err != nil || startTime != recordTime {
+			continue
+		}
+		tids, err := util.GetProcessThreadIDs(pid)
+		if err != nil {
+			return fmt.Errorf("get process %d threads failed: %v", pid, err)
+		}
+		for _, tid := range tids {
+			thread, ok := backup.Threads[tid]
+			if !ok {
+				// 注入期间新创建的线程继承了被修改后的属性，按主线程的原始属性恢复。
+				if thread, ok = backup.Threads[pid]; !ok {
+					continue
+				}
+			}
+			if err := setThreadPriority(tid, &backup, &thread); err != nil && err != unix.ESRCH {
+				return fmt.Errorf("restore thread %d priority failed: %v", tid, err)
+			}
+		}
+	}
+	return util.RemoveState(p.stateName())
+}
@@ -17,29 +17,40 @@ limitations under the License.
 package process
 
 import (
-	"errors"
 	"fmt"
 	"strconv"
+	"strings"
+	"syscall"
 
-	"arsenal-os/util"
+	"golang.org/x/sys/unix"
 )
 
-// processIsExist 检查进程是否存在。
-func processIsExist(pid int) bool {
-	return util.FileIsExist(fmt.Sprintf("/proc/%d", pid))
-}
+// maxSignalNumber linux支持的最大信号编号(SIGRTMAX)。
+const maxSignalNumber = 64
 
-// GetProcessPidAndExistCheck 检查输入参数pid对应进程是否存在。
-func GetProcessPidAndExistCheck(flagsMap map[string]string) (int, error) {
-	if _, ok := flagsMap["pid"]; !ok {
-		return -1, errors.New("please input params: pid")
+// parseSignal 解析信号名称或编号，名称可以省略SIG前缀，如：SIGSEGV、segv、11。
+func parseSignal(signalStr string) (syscall.Signal, error) {
+	if number, err := strconv.Atoi(signalStr); err == nil {
+		if number <= 0 || number > maxSignalNumber {
+			return 0, fmt.Errorf("signal number(%d) must be in range [1, %d]", number, maxSignalNumber)
+		}
+		return syscall.Signal(number), nil
+	}
+	name := strings.ToUpper(signalStr)
+	if !strings.HasPrefix(name, "SIG") {
+		name = "SIG" + name
 	}
-	pid, err := strconv.Atoi(flagsMap["pid"])
-	if err != nil {
-		return -1, fmt.Errorf("trans pid string to int failed: %v", err)
+	signal := unix.SignalNum(name)
+	if signal == 0 {
+		return 0, fmt.Errorf("invalid signal %s", signalStr)
 	}
-	if !processIsExist(pid) {
-		return pid, fmt.Errorf("the process: %d does not exist", pid)
+	return signal, nil
+}
+
+// signalName 获取信号名称，实时信号等没有名称的信号返回编号。
+func signalName(signal syscall.Signal) string {
+	if name := unix.SignalName(signal); name != "" {
+		return name
 	}
-	return pid, nil
+	return strconv.Itoa(int(signal))
 }
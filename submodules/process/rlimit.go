@@ -0,0 +1,187 @@
+/*
+Copyright 2023 Sangfor Technologies Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package process
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+
+	"arsenal-os/internal/parse"
+	"arsenal-os/submodules"
+	"arsenal-os/util"
+
+	"golang.org/x/sys/unix"
+)
+
+func init() {
+	var newFaultType = rlimit{
+		FaultType: "process-rlimit",
+	}
+	submodules.Add(newFaultType.FaultType, &newFaultType)
+}
+
+const unlimitedStr = "unlimited"
+
+// rlimitResources 支持修改的资源限制，isSize为true时限制值为字节数，支持K、M、G等单位。
+var rlimitResources = map[string]struct {
+	resource int
+	isSize   bool
+}{
+	"nofile": {resource: unix.RLIMIT_NOFILE},
+	"nproc":  {resource: unix.RLIMIT_NPROC},
+	"as":     {resource: unix.RLIMIT_AS, isSize: true},
+	"fsize":  {resource: unix.RLIMIT_FSIZE, isSize: true},
+	"stack":  {resource: unix.RLIMIT_STACK, isSize: true},
+}
+
+type rlimit struct {
+	FaultType string
+	flags     map[string]string
+	pids      []int
+	name      string
+	resource  int
+	soft      string
+	hard      string
+}
+
+func (r *rlimit) stateName() string {
+	return fmt.Sprintf("%s-%s", util.SelectorStateName(r.FaultType, r.flags), r.name)
+}
+
+// parseLimit 解析限制值，unlimited表示不限制。
+func (r *rlimit) parseLimit(name, value string) (uint64, error) {
+	if value == unlimitedStr {
+		return unix.RLIM_INFINITY, nil
+	}
+	if rlimitResources[r.name].isSize {
+		size, err := util.ParseSize(value)
+		if err != nil {
+			return 0, fmt.Errorf("%s param error: %v", name, err)
+		}
+		return size, nil
+	}
+	limit, err := strconv.ParseUint(value, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("%s param(%s) must be a non-negative integer or %s", name, value, unlimitedStr)
+	}
+	return limit, nil
+}
+
+func formatLimit(limit uint64) string {
+	if limit == unix.RLIM_INFINITY {
+		return unlimitedStr
+	}
+	return strconv.FormatUint(limit, 10)
+}
+
+func (r *rlimit) Prepare(inputArgs []string) error {
+	r.flags = parse.TransInputFlagsToMap(inputArgs)
+	r.name = r.flags["resource"]
+	resource, ok := rlimitResources[r.name]
+	if !ok {
+		return fmt.Errorf("invalid resource %s, example: nofile, nproc, as, fsize, stack", r.name)
+	}
+	r.resource = resource.resource
+	if inputArgs[submodules.OpsTypeIndex] == submodules.Remove {
+		return nil
+	}
+
+	pids, err := util.GetTargetProcesses(r.flags)
+	if err != nil {
+		return err
+	}
+	r.pids = pids
+
+	soft, ok := r.flags["soft"]
+	if !ok {
+		return errors.New("please input param soft")
+	}
+	softLimit, err := r.parseLimit("soft", soft)
+	if err != nil {
+		return err
+	}
+	if hard, ok := r.flags["hard"]; ok {
+		hardLimit, err := r.parseLimit("hard", hard)
+		if err != nil {
+			return err
+		}
+		if softLimit > hardLimit {
+			return fmt.Errorf("soft limit(%s) is larger than hard limit(%s)", soft, hard)
+		}
+		// 降低后的硬限制需要CAP_SYS_RESOURCE能力才能恢复。
+		if !util.HasCapability(unix.CAP_SYS_RESOURCE) {
+			return errors.New("changing hard limit requires CAP_SYS_RESOURCE capability to restore")
+		}
+		r.hard = hard
+	}
+	r.soft = soft
+	return nil
+}
+
+// newLimit 计算目标进程新的资源限制，未指定hard时保持原硬限制。
+func (r *rlimit) newLimit(old unix.Rlimit) (unix.Rlimit, error) {
+	limit := old
+	limit.Cur, _ = r.parseLimit("soft", r.soft)
+	if r.hard != "" {
+		limit.Max, _ = r.parseLimit("hard", r.hard)
+	}
+	if limit.Cur > limit.Max {
+		return limit, fmt.Errorf("soft limit(%s) is larger than hard limit(%s)", r.soft, formatLimit(limit.Max))
+	}
+	return limit, nil
+}
+
+func (r *rlimit) FaultInject(_ []string) error {
+	if util.StateIsExist(r.stateName()) {
+		return fmt.Errorf("%s fault has been injected", r.FaultType)
+	}
+
+	backup, err := util.NewRlimitBackup(r.pids, r.resource)
+	if err != nil {
+		return err
+	}
+	if err := util.SaveState(r.stateName(), backup); err != nil {
+		return err
+	}
+
+	for _, pid := range r.pids {
+		limit, err := r.newLimit(backup.Limits[pid].Limit)
+		if err != nil {
+			return fmt.Errorf("process %d: %v", pid, err)
+		}
+		if err := unix.Prlimit(pid, r.resource, &limit, nil); err != nil {
+			return fmt.Errorf("set process %d %s limit failed: %v", pid, r.name, err)
+		}
+		fmt.Printf("process %d %s limit: soft %s, hard %s\n", pid, r.name, formatLimit(limit.Cur), formatLimit(limit.Max))
+	}
+	return nil
+}
+
+func (r *rlimit) FaultRemove(_ []string) error {
+	if !util.StateIsExist(r.stateName()) {
+		return nil
+	}
+	var backup util.RlimitBackup
+	if err := util.LoadState(r.stateName(), &backup); err != nil {
+		return err
+	}
+	if err := backup.Restore(); err != nil {
+		return err
+	}
+	return util.RemoveState(r.stateName())
+}
@@ -0,0 +1,578 @@
+/*
+Copyright 2023 Sangfor Technologies Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package process
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+	"unsafe"
+
+	"arsenal-os/internal/parse"
+	"arsenal-os/submodules"
+	"arsenal-os/util"
+
+	"golang.org/x/sys/unix"
+)
+
+func init() {
+	var newFaultType = syscallFault{
+		FaultType: "process-syscall-fault",
+	}
+	submodules.Add(newFaultType.FaultType, &newFaultType)
+
+	// 内核支持的errno不超过255个。
+	for errno := syscall.Errno(1); errno < 256; errno++ {
+		if name := unix.ErrnoName(errno); name != "" {
+			errnoNumbers[name] = errno
+		}
+	}
+}
+
+const (
+	ptraceScopePath = "/proc/sys/kernel/yama/ptrace_scope"
+	// ptraceScopeNoAttach ptrace_scope为3时禁止任何进程使用ptrace attach。
+	ptraceScopeNoAttach = "3"
+	// tracerPollInterval SIGCHLD通知丢失时的兜底检查周期。
+	tracerPollInterval = 100 * time.Millisecond
+	// syscallStopSignal 设置PTRACE_O_TRACESYSGOOD后系统调用停止的信号。
+	syscallStopSignal = syscall.SIGTRAP | 0x80
+	// atFdcwd *at系列系统调用中表示相对当前工作目录的dirfd。
+	atFdcwd = -100
+	// maxPathLen 从目标进程内存中读取路径的最大长度。
+	maxPathLen = 4096
+)
+
+// 文件类系统调用中与路径相关的参数类型。
+const (
+	// fileArgPath 参数为路径字符串。
+	fileArgPath = iota
+	// fileArgFd 参数为文件描述符。
+	fileArgFd
+	// fileArgAt 参数为dirfd，下一个参数为相对dirfd的路径字符串。
+	fileArgAt
+)
+
+// fileArg 文件类系统调用中用于--path过滤的参数位置。
+type fileArg struct {
+	kind  int
+	index int
+}
+
+var (
+	// syscallNumbers 支持注入的系统调用，系统调用号与架构相关，在对应架构的文件中初始化。
+	syscallNumbers = make(map[string]uint64)
+
+	// fileSyscalls 支持--path过滤的文件类系统调用。
+	fileSyscalls = map[string]fileArg{
+		"read":            {kind: fileArgFd, index: 0},
+		"write":           {kind: fileArgFd, index: 0},
+		"pread64":         {kind: fileArgFd, index: 0},
+		"pwrite64":        {kind: fileArgFd, index: 0},
+		"readv":           {kind: fileArgFd, index: 0},
+		"writev":          {kind: fileArgFd, index: 0},
+		"openat":          {kind: fileArgAt, index: 0},
+		"close":           {kind: fileArgFd, index: 0},
+		"fsync":           {kind: fileArgFd, index: 0},
+		"fdatasync":       {kind: fileArgFd, index: 0},
+		"sync_file_range": {kind: fileArgFd, index: 0},
+		"fallocate":       {kind: fileArgFd, index: 0},
+		"ftruncate":       {kind: fileArgFd, index: 0},
+		"truncate":        {kind: fileArgPath, index: 0},
+		"flock":           {kind: fileArgFd, index: 0},
+		"getdents64":      {kind: fileArgFd, index: 0},
+		"unlinkat":        {kind: fileArgAt, index: 0},
+		"renameat":        {kind: fileArgAt, index: 0},
+		"renameat2":       {kind: fileArgAt, index: 0},
+		"mkdirat":         {kind: fileArgAt, index: 0},
+		"statfs":          {kind: fileArgPath, index: 0},
+		"fstatfs":         {kind: fileArgFd, index: 0},
+		"execve":          {kind: fileArgPath, index: 0},
+	}
+
+	// errnoNumbers errno名称和编号的对应关系，如：EIO。
+	errnoNumbers = make(map[string]syscall.Errno)
+)
+
+type syscallFault struct {
+	FaultType   string
+	flags       map[string]string
+	pids        []int
+	syscalls    map[uint64]string
+	errno       syscall.Errno
+	latency     time.Duration
+	probability float64
+	path        string
+}
+
+// ptraceSyscallInfo PTRACE_GET_SYSCALL_INFO返回的系统调用信息，
+// 入口停止时data为系统调用号和6个参数，出口停止时data[0]为返回值。
+type ptraceSyscallInfo struct {
+	Op                 uint8
+	_                  [3]uint8
+	Arch               uint32
+	InstructionPointer uint64
+	StackPointer       uint64
+	Data               [7]uint64
+}
+
+// tracedThread 被跟踪线程的注入状态。
+type tracedThread struct {
+	// errno 非0时已在入口处跳过系统调用，需要在出口处设置返回值。
+	errno syscall.Errno
+	// resumeTime 非0时线程停在系统调用入口等待延迟结束。
+	resumeTime time.Time
+	// isSkip 延迟结束后是否需要跳过系统调用。
+	isSkip bool
+}
+
+type syscallTracer struct {
+	fault    *syscallFault
+	threads  map[int]*tracedThread
+	random   *rand.Rand
+	injected int
+}
+
+func (s *syscallFault) stateName() string {
+	return util.SelectorStateName(s.FaultType, s.flags)
+}
+
+func (s *syscallFault) syscallsParser() error {
+	syscallStr, ok := s.flags["syscall"]
+	if !ok {
+		return errors.New("please input param syscall, example: write,fsync")
+	}
+	s.syscalls = make(map[uint64]string)
+	for _, name := range strings.Split(syscallStr, ",") {
+		number, ok := syscallNumbers[name]
+		if !ok {
+			return fmt.Errorf("unsupported syscall %s on %s", name, runtime.GOARCH)
+		}
+		if _, ok := s.flags["path"]; ok {
+			if _, ok := fileSyscalls[name]; !ok {
+				return fmt.Errorf("syscall %s does not support param path", name)
+			}
+		}
+		s.syscalls[number] = name
+	}
+	return nil
+}
+
+func (s *syscallFault) injectionParser() error {
+	if errnoStr, ok := s.flags["errno"]; ok {
+		if number, err := strconv.Atoi(errnoStr); err == nil && number > 0 {
+			s.errno = syscall.Errno(number)
+		} else if s.errno, ok = errnoNumbers[strings.ToUpper(errnoStr)]; !ok {
+			return fmt.Errorf("invalid errno %s, example: EIO", errnoStr)
+		}
+	}
+	if latencyStr, ok := s.flags["latency-ms"]; ok {
+		latency, err := strconv.Atoi(latencyStr)
+		if err != nil || latency <= 0 {
+			return fmt.Errorf("latency-ms param(%s) must be a positive integer", latencyStr)
+		}
+		s.latency = time.Duration(latency) * time.Millisecond
+	}
+	if s.errno == 0 && s.latency == 0 {
+		return errors.New("please input param errno or latency-ms")
+	}
+
+	s.probability = 100
+	if probabilityStr, ok := s.flags["probability"]; ok {
+		probability, err := strconv.ParseFloat(probabilityStr, 64)
+		if err != nil || probability <= 0 || probability > 100 {
+			return fmt.Errorf("probability param(%s) must be in range (0, 100]", probabilityStr)
+		}
+		s.probability = probability
+	}
+	s.path = s.flags["path"]
+	return nil
+}
+
+func (s *syscallFault) Prepare(inputArgs []string) error {
+	s.flags = parse.TransInputFlagsToMap(inputArgs)
+	if inputArgs[submodules.OpsTypeIndex] == submodules.Remove {
+		return nil
+	}
+	if data, err := ioutil.ReadFile(ptraceScopePath); err == nil && strings.TrimSpace(string(data)) == ptraceScopeNoAttach {
+		return fmt.Errorf("ptrace attach is disabled by %s", ptraceScopePath)
+	}
+	pids, err := util.GetTargetProcesses(s.flags)
+	if err != nil {
+		return err
+	}
+	s.pids = pids
+
+	if err := s.syscallsParser(); err != nil {
+		return err
+	}
+	return s.injectionParser()
+}
+
+func getSyscallInfo(tid int) (*ptraceSyscallInfo, error) {
+	var info ptraceSyscallInfo
+	_, _, errno := unix.Syscall6(unix.SYS_PTRACE, unix.PTRACE_GET_SYSCALL_INFO, uintptr(tid),
+		unsafe.Sizeof(info), uintptr(unsafe.Pointer(&info)), 0, 0)
+	if errno != 0 {
+		return nil, errno
+	}
+	return &info, nil
+}
+
+func ptraceRequest(request, tid, data int) error {
+	_, _, errno := unix.Syscall6(unix.SYS_PTRACE, uintptr(request), uintptr(tid), 0, uintptr(data), 0, 0)
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+// readTraceeString 从目标线程内存中读取以'\0'结尾的字符串。
+func readTraceeString(tid int, address uint64) (string, error) {
+	file, err := os.Open(fmt.Sprintf("/proc/%d/mem", tid))
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	// 按页读取，避免跨越页边界读到未映射的内存。
+	pageSize := uint64(unix.Getpagesize())
+	var data []byte
+	for len(data) < maxPathLen {
+		buf := make([]byte, pageSize-address%pageSize)
+		count, err := file.ReadAt(buf, int64(address))
+		if count == 0 {
+			return "", err
+		}
+		if index := strings.IndexByte(string(buf[:count]), 0); index >= 0 {
+			return string(append(data, buf[:index]...)), nil
+		}
+		data = append(data, buf[:count]...)
+		address += uint64(count)
+	}
+	return "", errors.New("path is too long")
+}
+
+// resolveFilePath 获取文件类系统调用操作的文件路径。
+func resolveFilePath(tid int, arg fileArg, args []uint64) (string, error) {
+	switch arg.kind {
+	case fileArgFd:
+		return os.Readlink(fmt.Sprintf("/proc/%d/fd/%d", tid, int32(args[arg.index])))
+	case fileArgPath:
+		path, err := readTraceeString(tid, args[arg.index])
+		if err != nil || filepath.IsAbs(path) {
+			return path, err
+		}
+		cwd, err := os.Readlink(fmt.Sprintf("/proc/%d/cwd", tid))
+		return filepath.Join(cwd, path), err
+	}
+
+	path, err := readTraceeString(tid, args[arg.index+1])
+	if err != nil || filepath.IsAbs(path) {
+		return path, err
+	}
+	dirLink := fmt.Sprintf("/proc/%d/fd/%d", tid, int32(args[arg.index]))
+	if int32(args[arg.index]) == atFdcwd {
+		dirLink = fmt.Sprintf("/proc/%d/cwd", tid)
+	}
+	dir, err := os.Readlink(dirLink)
+	return filepath.Join(dir, path), err
+}
+
+// isTarget 判断系统调用是否需要注入故障。
+func (t *syscallTracer) isTarget(tid int, info *ptraceSyscallInfo) bool {
+	name, ok := t.fault.syscalls[info.Data[0]]
+	if !ok {
+		return false
+	}
+	if t.fault.path != "" {
+		path, err := resolveFilePath(tid, fileSyscalls[name], info.Data[1:])
+		if err != nil {
+			return false
+		}
+		path = filepath.Clean(path)
+		filterPath := filepath.Clean(t.fault.path)
+		if path != filterPath && !strings.HasPrefix(path, filterPath+"/") {
+			return false
+		}
+	}
+	return t.random.Float64()*100 < t.fault.probability
+}
+
+// resumeThread 恢复停在系统调用入口的线程，需要注入错误时跳过系统调用。
+func (t *syscallTracer) resumeThread(tid int, thread *tracedThread) error {
+	thread.resumeTime = time.Time{}
+	if thread.isSkip {
+		thread.isSkip = false
+		if err := skipSyscall(tid); err != nil {
+			return fmt.Errorf("skip syscall of thread %d failed: %v", tid, err)
+		}
+		thread.errno = t.fault.errno
+		t.injected++
+	}
+	return unix.PtraceSyscall(tid, 0)
+}
+
+func (t *syscallTracer) handleSyscallStop(tid int, thread *tracedThread) error {
+	info, err := getSyscallInfo(tid)
+	if err != nil {
+		return fmt.Errorf("get syscall info of thread %d failed(require kernel 5.3+): %v", tid, err)
+	}
+
+	switch info.Op {
+	case unix.PTRACE_SYSCALL_INFO_ENTRY:
+		if t.isTarget(tid, info) {
+			thread.isSkip = t.fault.errno != 0
+			if t.fault.latency != 0 {
+				thread.resumeTime = time.Now().Add(t.fault.latency)
+				if t.fault.errno == 0 {
+					t.injected++
+				}
+				return nil
+			}
+		}
+		return t.resumeThread(tid, thread)
+	case unix.PTRACE_SYSCALL_INFO_EXIT:
+		if thread.errno != 0 {
+			if err := setSyscallReturn(tid, -int64(thread.errno)); err != nil {
+				return fmt.Errorf("set syscall return of thread %d failed: %v", tid, err)
+			}
+			thread.errno = 0
+		}
+	}
+	return unix.PtraceSyscall(tid, 0)
+}
+
+// handleStop 处理被跟踪线程的状态变化。
+func (t *syscallTracer) handleStop(tid int, status unix.WaitStatus) error {
+	if status.Exited() || status.Signaled() {
+		delete(t.threads, tid)
+		return nil
+	}
+	if !status.Stopped() {
+		return nil
+	}
+	thread, ok := t.threads[tid]
+	if !ok {
+		// 新创建的线程的停止事件可能早于父线程的clone事件。
+		thread = &tracedThread{}
+		t.threads[tid] = thread
+	}
+
+	stopSignal := status.StopSignal()
+	switch event := uint32(status) >> 16; {
+	case stopSignal == syscallStopSignal:
+		return t.handleSyscallStop(tid, thread)
+	case event == unix.PTRACE_EVENT_STOP && stopSignal != syscall.SIGTRAP:
+		// 组停止需要PTRACE_LISTEN保持线程停止，直到收到SIGCONT。
+		return ptraceRequest(unix.PTRACE_LISTEN, tid, 0)
+	case event != 0:
+		// PTRACE_INTERRUPT、新线程创建等事件停止。
+		return unix.PtraceSyscall(tid, 0)
+	}
+	// 信号投递停止，将信号重新注入线程。
+	return unix.PtraceSyscall(tid, int(stopSignal))
+}
+
+// attach 跟踪目标进程的所有线程，线程创建的新线程通过PTRACE_O_TRACECLONE自动跟踪。
+func (t *syscallTracer) attach(pid int) error {
+	options := unix.PTRACE_O_TRACESYSGOOD | unix.PTRACE_O_TRACECLONE
+	// 遍历过程中可能有未被跟踪的线程创建新线程，重复遍历直到没有新线程。
+	for isNew := true; isNew; {
+		isNew = false
+		tids, err := util.GetProcessThreadIDs(pid)
+		if err != nil {
+			return err
+		}
+		for _, tid := range tids {
+			if _, ok := t.threads[tid]; ok {
+				continue
+			}
+			if err := ptraceRequest(unix.PTRACE_SEIZE, tid, options); err != nil {
+				return fmt.Errorf("ptrace seize thread %d failed: %v", tid, err)
+			}
+			t.threads[tid] = &tracedThread{}
+			isNew = true
+			// 线程在PTRACE_INTERRUPT停止后才能开始跟踪系统调用。
+			if err := unix.PtraceInterrupt(tid); err != nil {
+				return fmt.Errorf("ptrace interrupt thread %d failed: %v", tid, err)
+			}
+		}
+	}
+	return nil
+}
+
+// detach 停止跟踪所有线程，已跳过的系统调用在出口处设置返回值后再脱离，保证目标进程不会看到异常的返回值。
+func (t *syscallTracer) detach() {
+	for tid, thread := range t.threads {
+		// 等待延迟的线程停在系统调用入口，且尚未修改系统调用，可以直接脱离。
+		if !thread.resumeTime.IsZero() {
+			unix.PtraceDetach(tid)
+			delete(t.threads, tid)
+			continue
+		}
+		unix.PtraceInterrupt(tid)
+	}
+
+	for len(t.threads) != 0 {
+		var status unix.WaitStatus
+		tid, err := unix.Wait4(-1, &status, unix.WALL, nil)
+		if err != nil {
+			if err == syscall.EINTR {
+				continue
+			}
+			return
+		}
+		thread, ok := t.threads[tid]
+		if status.Exited() || status.Signaled() || !status.Stopped() {
+			delete(t.threads, tid)
+			continue
+		}
+		if ok && thread.errno != 0 {
+			info, err := getSyscallInfo(tid)
+			if err != nil || info.Op != unix.PTRACE_SYSCALL_INFO_EXIT {
+				unix.PtraceSyscall(tid, 0)
+				continue
+			}
+			setSyscallReturn(tid, -int64(thread.errno))
+		}
+
+		signal := 0
+		if status.StopSignal() != syscallStopSignal && uint32(status)>>16 == 0 {
+			signal = int(status.StopSignal())
+		}
+		ptraceRequest(unix.PTRACE_DETACH, tid, signal)
+		delete(t.threads, tid)
+	}
+}
+
+// nextResumeTime 返回最早结束延迟的时间，没有等待延迟的线程时返回0。
+func (t *syscallTracer) nextResumeTime() time.Time {
+	var next time.Time
+	for _, thread := range t.threads {
+		if !thread.resumeTime.IsZero() && (next.IsZero() || thread.resumeTime.Before(next)) {
+			next = thread.resumeTime
+		}
+	}
+	return next
+}
+
+// handleEvents 处理所有已经发生的线程状态变化，并恢复延迟结束的线程。
+func (t *syscallTracer) handleEvents() error {
+	for {
+		var status unix.WaitStatus
+		tid, err := unix.Wait4(-1, &status, unix.WNOHANG|unix.WALL, nil)
+		if err == syscall.EINTR {
+			continue
+		}
+		if err == syscall.ECHILD || tid == 0 {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("wait traced threads failed: %v", err)
+		}
+		// 线程可能在处理过程中被杀死，忽略单个线程的失败。
+		if err := t.handleStop(tid, status); err != nil && err != syscall.ESRCH {
+			fmt.Printf("handle thread %d stop failed: %v\n", tid, err)
+		}
+	}
+
+	now := time.Now()
+	for tid, thread := range t.threads {
+		if thread.resumeTime.IsZero() || thread.resumeTime.After(now) {
+			continue
+		}
+		if err := t.resumeThread(tid, thread); err != nil && err != syscall.ESRCH {
+			fmt.Printf("resume thread %d failed: %v\n", tid, err)
+		}
+	}
+	return nil
+}
+
+// FaultInject 后台常驻，通过ptrace跟踪目标进程的系统调用并按概率注入错误或延迟。
+func (s *syscallFault) FaultInject(_ []string) error {
+	if util.KeeperIsRunning(s.stateName()) {
+		return fmt.Errorf("%s fault has been injected", s.FaultType)
+	}
+	// ptrace请求必须由同一个线程发出。
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+
+	stopChan, err := util.StartKeeper(s.stateName())
+	if err != nil {
+		return err
+	}
+	defer util.FinishKeeper(s.stateName())
+	// 被跟踪线程停止时tracer会收到SIGCHLD。
+	childChan := make(chan os.Signal, 1)
+	signal.Notify(childChan, syscall.SIGCHLD)
+	defer signal.Stop(childChan)
+
+	tracer := syscallTracer{
+		fault:   s,
+		threads: make(map[int]*tracedThread),
+		random:  rand.New(rand.NewSource(time.Now().UnixNano())),
+	}
+	defer func() {
+		tracer.detach()
+		fmt.Printf("detached, injected %d syscalls\n", tracer.injected)
+	}()
+	for _, pid := range s.pids {
+		if err := tracer.attach(pid); err != nil {
+			return err
+		}
+	}
+
+	ticker := time.NewTicker(tracerPollInterval)
+	defer ticker.Stop()
+	for {
+		if err := tracer.handleEvents(); err != nil {
+			return err
+		}
+		if len(tracer.threads) == 0 {
+			return errors.New("all target processes have exited")
+		}
+
+		var resumeChan <-chan time.Time
+		if next := tracer.nextResumeTime(); !next.IsZero() {
+			resumeChan = time.After(time.Until(next))
+		}
+		select {
+		case <-stopChan:
+			return nil
+		case <-childChan:
+		case <-resumeChan:
+		case <-ticker.C:
+		}
+	}
+}
+
+func (s *syscallFault) FaultRemove(_ []string) error {
+	if err := util.StopKeeper(s.stateName()); err != nil {
+		return fmt.Errorf("remove %s failed: %v", s.FaultType, err)
+	}
+	return nil
+}
@@ -0,0 +1,99 @@
+/*
+Copyright 2023 Sangfor Technologies Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package process
+
+import (
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+const (
+	ntPrstatus = 1
+	// ntArmSystemCall arm64通过该寄存器集修改系统调用号。
+	ntArmSystemCall = 0x404
+)
+
+func init() {
+	syscallNumbers = map[string]uint64{
+		"read":            unix.SYS_READ,
+		"write":           unix.SYS_WRITE,
+		"pread64":         unix.SYS_PREAD64,
+		"pwrite64":        unix.SYS_PWRITE64,
+		"readv":           unix.SYS_READV,
+		"writev":          unix.SYS_WRITEV,
+		"openat":          unix.SYS_OPENAT,
+		"close":           unix.SYS_CLOSE,
+		"fsync":           unix.SYS_FSYNC,
+		"fdatasync":       unix.SYS_FDATASYNC,
+		"sync_file_range": unix.SYS_SYNC_FILE_RANGE,
+		"fallocate":       unix.SYS_FALLOCATE,
+		"ftruncate":       unix.SYS_FTRUNCATE,
+		"truncate":        unix.SYS_TRUNCATE,
+		"flock":           unix.SYS_FLOCK,
+		"getdents64":      unix.SYS_GETDENTS64,
+		"unlinkat":        unix.SYS_UNLINKAT,
+		"renameat":        unix.SYS_RENAMEAT,
+		"renameat2":       unix.SYS_RENAMEAT2,
+		"mkdirat":         unix.SYS_MKDIRAT,
+		"statfs":          unix.SYS_STATFS,
+		"fstatfs":         unix.SYS_FSTATFS,
+		"socket":          unix.SYS_SOCKET,
+		"bind":            unix.SYS_BIND,
+		"listen":          unix.SYS_LISTEN,
+		"connect":         unix.SYS_CONNECT,
+		"accept":          unix.SYS_ACCEPT,
+		"accept4":         unix.SYS_ACCEPT4,
+		"sendto":          unix.SYS_SENDTO,
+		"recvfrom":        unix.SYS_RECVFROM,
+		"sendmsg":         unix.SYS_SENDMSG,
+		"recvmsg":         unix.SYS_RECVMSG,
+		"mmap":            unix.SYS_MMAP,
+		"clone":           unix.SYS_CLONE,
+		"execve":          unix.SYS_EXECVE,
+		// arm64的newfstatat在头文件中名为fstatat。
+		"newfstatat": unix.SYS_FSTATAT,
+	}
+	fileSyscalls["newfstatat"] = fileArg{kind: fileArgAt, index: 0}
+}
+
+func ptraceRegSet(request, tid, regSet int, data unsafe.Pointer, size uintptr) error {
+	iovec := unix.Iovec{Base: (*byte)(data)}
+	iovec.SetLen(int(size))
+	_, _, errno := unix.Syscall6(unix.SYS_PTRACE, uintptr(request), uintptr(tid), uintptr(regSet),
+		uintptr(unsafe.Pointer(&iovec)), 0, 0)
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+// skipSyscall 在系统调用入口处将系统调用号修改为-1，内核不会执行该系统调用。
+func skipSyscall(tid int) error {
+	number := int32(-1)
+	return ptraceRegSet(unix.PTRACE_SETREGSET, tid, ntArmSystemCall, unsafe.Pointer(&number), unsafe.Sizeof(number))
+}
+
+// setSyscallReturn 在系统调用出口处修改返回值，错误以负的errno返回。
+func setSyscallReturn(tid int, value int64) error {
+	var regs unix.PtraceRegs
+	if err := ptraceRegSet(unix.PTRACE_GETREGSET, tid, ntPrstatus, unsafe.Pointer(&regs), unsafe.Sizeof(regs)); err != nil {
+		return err
+	}
+	regs.Regs[0] = uint64(value)
+	return ptraceRegSet(unix.PTRACE_SETREGSET, tid, ntPrstatus, unsafe.Pointer(&regs), unsafe.Sizeof(regs))
+}
@@ -0,0 +1,33 @@
+//go:build !amd64 && !arm64
+// +build !amd64,!arm64
+
+/*
+Copyright 2023 Sangfor Technologies Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package process
+
+import (
+	"fmt"
+	"runtime"
+)
+
+func skipSyscall(_ int) error {
+	return fmt.Errorf("syscall fault is not supported on %s", runtime.GOARCH)
+}
+
+func setSyscallReturn(_ int, _ int64) error {
+	return fmt.Errorf("syscall fault is not supported on %s", runtime.GOARCH)
+}
@@ -0,0 +1,219 @@
+/*
+Copyright 2023 Sangfor Technologies Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package process
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"arsenal-os/internal/parse"
+	"arsenal-os/submodules"
+	"arsenal-os/util"
+
+	"golang.org/x/sys/unix"
+)
+
+func init() {
+	var newFaultType = zombie{
+		FaultType: "process-zombie",
+	}
+	submodules.Add(newFaultType.FaultType, &newFaultType)
+}
+
+const (
+	// zombieMaxCount 单次注入最多创建的僵尸进程或孤儿进程数量，每个进程都会占用一个pid。
+	zombieMaxCount = 10000
+)
+
+// zombie keeper创建子进程后不回收，子进程退出后成为僵尸进程直到keeper退出。
+// PR_SET_CHILD_SUBREAPER只能由进程自身设置，因此无法让任意目标进程接管孤儿进程，
+// 指定--subreaper时由keeper作为subreaper接管孤儿进程。
+type zombie struct {
+	FaultType string
+	flags     map[string]string
+	count     int
+	orphans   int
+	subreaper bool
+}
+
+// orphanRecord 记录孤儿进程，keeper被强制杀死后清理时仍能找到它们。
+type orphanRecord struct {
+	Pgid int
+	Pids []int
+}
+
+func parseProcessCount(flagsMap map[string]string, name string) (int, error) {
+	countStr, ok := flagsMap[name]
+	if !ok {
+		return 0, nil
+	}
+	count, err := strconv.Atoi(countStr)
+	if err != nil || count < 0 || count > zombieMaxCount {
+		return 0, fmt.Errorf("%s param(%s) must be in range [0, %d]", name, countStr, zombieMaxCount)
+	}
+	return count, nil
+}
+
+func (z *zombie) Prepare(inputArgs []string) error {
+	z.flags = parse.TransInputFlagsToMap(inputArgs)
+	if inputArgs[submodules.OpsTypeIndex] == submodules.Remove {
+		return nil
+	}
+	if _, ok := z.flags["pid"]; ok {
+		return errors.New("PR_SET_CHILD_SUBREAPER can only be set by the process itself, param pid is not supported")
+	}
+
+	var err error
+	if z.count, err = parseProcessCount(z.flags, "count"); err != nil {
+		return err
+	}
+	if z.orphans, err = parseProcessCount(z.flags, "orphans"); err != nil {
+		return err
+	}
+	if z.count == 0 && z.orphans == 0 {
+		return errors.New("please input param count or orphans")
+	}
+	if z.subreaper, err = parse.GetBoolFlag(z.flags, "subreaper"); err != nil {
+		return err
+	}
+	if missingCmd, isMissCmd := util.CheckEnvShellCommand([]string{"true", "sh", "sleep"}); isMissCmd {
+		return fmt.Errorf("missing command: %s", missingCmd)
+	}
+	return nil
+}
+
+// createZombies 创建立即退出的子进程，不调用Wait回收，子进程保持僵尸状态。
+func createZombies(count int) ([]int, error) {
+	truePath, err := exec.LookPath("true")
+	if err != nil {
+		return nil, fmt.Errorf("look path of true failed: %v", err)
+	}
+	pids := make([]int, 0, count)
+	for index := 0; index < count; index++ {
+		child := exec.Command(truePath)
+		if err := child.Start(); err != nil {
+			return pids, fmt.Errorf("create child process failed: %v", err)
+		}
+		pids = append(pids, child.Process.Pid)
+	}
+	return pids, nil
+}
+
+// createOrphans 通过sh在后台启动sleep后退出，sleep的父进程退出后成为孤儿进程，
+// 由最近的subreaper祖先进程或init接管，所有孤儿进程位于同一进程组。
+func createOrphans(count int) (*orphanRecord, error) {
+	record := orphanRecord{}
+	for index := 0; index < count; index++ {
+		shell := exec.Command("sh", "-c", fmt.Sprintf("sleep %s >/dev/null 2>&1 & echo $!", util.SleepForever))
+		shell.SysProcAttr = &syscall.SysProcAttr{Setpgid: true, Pgid: record.Pgid}
+		output, err := shell.Output()
+		if err != nil {
+			return &record, fmt.Errorf("create orphan process failed: %v", err)
+		}
+		pid, err := strconv.Atoi(strings.TrimSpace(string(output)))
+		if err != nil {
+			return &record, fmt.Errorf("trans orphan pid to int failed: %v", err)
+		}
+		// sh是进程组的组长，sh退出后进程组随孤儿进程继续存在。
+		if record.Pgid == 0 {
+			record.Pgid = shell.Process.Pid
+		}
+		record.Pids = append(record.Pids, pid)
+	}
+	return &record, nil
+}
+
+// killOrphans 杀死仍在原进程组中的孤儿进程，避免误杀pid复用后的其他进程。
+func killOrphans(record *orphanRecord) {
+	for _, pid := range record.Pids {
+		if pgid, err := unix.Getpgid(pid); err != nil || pgid != record.Pgid {
+			continue
+		}
+		if err := syscall.Kill(pid, syscall.SIGKILL); err != nil && err != syscall.ESRCH {
+			fmt.Printf("kill orphan process %d failed: %v\n", pid, err)
+		}
+	}
+}
+
+func (z *zombie) FaultInject(_ []string) error {
+	if util.StateIsExist(z.FaultType) || util.KeeperIsRunning(z.FaultType) {
+		return fmt.Errorf("%s fault has been injected", z.FaultType)
+	}
+	stopChan, err := util.StartKeeper(z.FaultType)
+	if err != nil {
+		return err
+	}
+	defer util.FinishKeeper(z.FaultType)
+
+	if z.subreaper {
+		if err := unix.Prctl(unix.PR_SET_CHILD_SUBREAPER, 1, 0, 0, 0); err != nil {
+			return fmt.Errorf("set PR_SET_CHILD_SUBREAPER failed: %v", err)
+		}
+	}
+
+	record, err := createOrphans(z.orphans)
+	if len(record.Pids) != 0 {
+		defer func() {
+			killOrphans(record)
+			util.RemoveState(z.FaultType)
+		}()
+		if err := util.SaveState(z.FaultType, record); err != nil {
+			return err
+		}
+	}
+	if err != nil {
+		return err
+	}
+	zombies, err := createZombies(z.count)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("keeper %d created %d zombie processes: %v\n", os.Getpid(), len(zombies), zombies)
+	if len(record.Pids) != 0 {
+		parent := "init"
+		if z.subreaper {
+			parent = fmt.Sprintf("keeper %d", os.Getpid())
+		}
+		fmt.Printf("created %d orphan processes adopted by %s: %v\n", len(record.Pids), parent, record.Pids)
+	}
+
+	// keeper退出后僵尸进程被init回收。
+	<-stopChan
+	return nil
+}
+
+func (z *zombie) FaultRemove(_ []string) error {
+	if err := util.StopKeeper(z.FaultType); err != nil {
+		return fmt.Errorf("remove %s failed: %v", z.FaultType, err)
+	}
+
+	if !util.StateIsExist(z.FaultType) {
+		return nil
+	}
+	var record orphanRecord
+	if err := util.LoadState(z.FaultType, &record); err != nil {
+		return err
+	}
+	killOrphans(&record)
+	return util.RemoveState(z.FaultType)
+}
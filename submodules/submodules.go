@@ -33,6 +33,8 @@ var (
 	Inject = "inject"
 	// Remove 故障清理字符串标志。
 	Remove = "remove"
+	// Status 故障状态查询字符串标志。
+	Status = "status"
 	// FaultOperationTypes 故障操作类型集合。
 	FaultOperationTypes = map[string]FaultOperationType{}
 	// FaultTypes 故障模式对应处理函数集合。
@@ -53,6 +55,12 @@ type FaultOperations interface {
 	FaultRemove([]string) error
 }
 
+// FaultStatus 支持状态查询的故障模式额外实现的接口。
+type FaultStatus interface {
+	// FaultStatus 故障状态查询入口。
+	FaultStatus([]string) error
+}
+
 func RunCmd(inputArgs []string) error {
 	// 检查是否支持对应的faultType。
 	faultTypeKey := fmt.Sprintf("%s-%s", inputArgs[ModuleNameIndex], inputArgs[FaultTypeIndex])
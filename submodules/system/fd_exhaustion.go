@@ -0,0 +1,426 @@
+/*
+Copyright 2023 Sangfor Technologies Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package system
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os/user"
+	"runtime"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"arsenal-os/internal/parse"
+	"arsenal-os/submodules"
+	"arsenal-os/util"
+
+	"golang.org/x/sys/unix"
+)
+
+func init() {
+	var newFaultType = fdExhaustion{
+		FaultType: "system-fd-exhaustion",
+	}
+	submodules.Add(newFaultType.FaultType, &newFaultType)
+}
+
+const (
+	fileNrPath  = "/proc/sys/fs/file-nr"
+	fileMaxPath = "/proc/sys/fs/file-max"
+	nrOpenPath  = "/proc/sys/fs/nr_open"
+	// fdReserve keeper自身运行需要保留的文件描述符数量。
+	fdReserve = 64
+	// fileCost 每个打开的文件大约占用的内核内存，包括file结构和文件描述符表项。
+	fileCost = 512
+)
+
+// fdExhaustion system模式占用文件句柄使系统已分配文件数接近fs.file-max，内核允许root超过fs.file-max，
+// 因此只有非root进程打开文件会返回ENFILE，单个文件描述符表受RLIMIT_NOFILE限制，不足时由多个独立文件描述符表的线程分担。
+// Linux没有按用户统计的文件描述符数量，user模式下keeper切换为目标用户并耗尽RLIMIT_NOFILE，模拟该用户的进程打开文件过多。
+type fdExhaustion struct {
+	FaultType string
+	flags     map[string]string
+	mode      string
+	percent   float64
+	fileMax   uint64
+	uid       int
+	gid       int
+}
+
+// fileMaxBackup 记录注入前的fs.file-max。
+type fileMaxBackup struct {
+	FileMax string
+}
+
+func readProcSysUint(path string, index int) (uint64, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return 0, fmt.Errorf("read %s failed: %v", path, err)
+	}
+	fields := strings.Fields(string(data))
+	if len(fields) <= index {
+		return 0, fmt.Errorf("invalid %s format", path)
+	}
+	value, err := strconv.ParseUint(fields[index], 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("trans %s value to int failed: %v", path, err)
+	}
+	return value, nil
+}
+
+// keeperName 每个用户的user模式故障由独立的keeper维持，可以与system模式同时注入。
+func (f *fdExhaustion) keeperName() string {
+	if f.mode == "user" {
+		return fmt.Sprintf("%s-user-%d", f.FaultType, f.uid)
+	}
+	return f.FaultType
+}
+
+func (f *fdExhaustion) userParser(opsType string) error {
+	userStr, ok := f.flags["user"]
+	if !ok {
+		return errors.New("please input param user")
+	}
+	userInfo, err := user.Lookup(userStr)
+	if err != nil {
+		if userInfo, err = user.LookupId(userStr); err != nil {
+			return fmt.Errorf("lookup user %s failed: %v", userStr, err)
+		}
+	}
+	if f.uid, err = strconv.Atoi(userInfo.Uid); err != nil {
+		return fmt.Errorf("trans uid string to int failed: %v", err)
+	}
+	if f.gid, err = strconv.Atoi(userInfo.Gid); err != nil {
+		return fmt.Errorf("trans gid string to int failed: %v", err)
+	}
+	if opsType == submodules.Remove {
+		return nil
+	}
+	if f.uid == 0 {
+		return errors.New("user mode does not support root, please use system mode")
+	}
+	return nil
+}
+
+// maxTableFds 获取单个文件描述符表最多能打开的文件数，提高硬限制需要CAP_SYS_RESOURCE能力。
+func maxTableFds() (uint64, error) {
+	var limit unix.Rlimit
+	if err := unix.Getrlimit(unix.RLIMIT_NOFILE, &limit); err != nil {
+		return 0, fmt.Errorf("get RLIMIT_NOFILE failed: %v", err)
+	}
+	if !util.HasCapability(unix.CAP_SYS_RESOURCE) {
+		return limit.Max, nil
+	}
+	return readProcSysUint(nrOpenPath, 0)
+}
+
+func (f *fdExhaustion) systemParser() error {
+	if fileMaxStr, ok := f.flags["file-max"]; ok {
+		fileMax, err := strconv.ParseUint(fileMaxStr, 10, 64)
+		if err != nil || fileMax == 0 {
+			return fmt.Errorf("file-max param(%s) must be a positive integer", fileMaxStr)
+		}
+		f.fileMax = fileMax
+	}
+	f.percent = 100
+	if percentStr, ok := f.flags["percent"]; ok {
+		percent, err := strconv.ParseFloat(percentStr, 64)
+		if err != nil || percent <= 0 || percent > 100 {
+			return fmt.Errorf("percent param(%s) must be in range (0, 100]", percentStr)
+		}
+		f.percent = percent
+	}
+
+	maxFds, err := maxTableFds()
+	if err != nil {
+		return err
+	}
+	if maxFds <= fdReserve {
+		return fmt.Errorf("RLIMIT_NOFILE(%d) is too small to open files", maxFds)
+	}
+	// 限制打开文件占用的内核内存，避免在耗尽文件句柄前触发OOM killer。
+	need, err := f.needFds()
+	if err != nil {
+		return err
+	}
+	available, err := util.GetMemInfoItem("MemAvailable")
+	if err != nil {
+		return err
+	}
+	if need*fileCost > available/2 {
+		return fmt.Errorf("%d files need about %s memory, more than half of available memory(%s), please lower file-max by param file-max",
+			need, util.FormatSize(need*fileCost), util.FormatSize(available))
+	}
+	return nil
+}
+
+func (f *fdExhaustion) Prepare(inputArgs []string) error {
+	f.flags = parse.TransInputFlagsToMap(inputArgs)
+	f.mode = "system"
+	if mode, ok := f.flags["mode"]; ok {
+		f.mode = mode
+	}
+	if f.mode != "system" && f.mode != "user" {
+		return fmt.Errorf("invalid mode %s, example: system, user", f.mode)
+	}
+	if f.mode == "user" {
+		return f.userParser(inputArgs[submodules.OpsTypeIndex])
+	}
+	if inputArgs[submodules.OpsTypeIndex] == submodules.Remove {
+		return nil
+	}
+	return f.systemParser()
+}
+
+// needFds 计算已分配文件数达到目标值还需要打开的文件数，指定--file-max时按降低后的值计算。
+func (f *fdExhaustion) needFds() (uint64, error) {
+	fileMax := f.fileMax
+	if fileMax == 0 {
+		var err error
+		if fileMax, err = readProcSysUint(fileMaxPath, 0); err != nil {
+			return 0, err
+		}
+	}
+	allocated, err := readProcSysUint(fileNrPath, 0)
+	if err != nil {
+		return 0, err
+	}
+	target := uint64(float64(fileMax) * f.percent / 100)
+	if allocated >= target {
+		return 0, nil
+	}
+	return target - allocated, nil
+}
+
+// lowerFileMax 保存原始值后临时降低fs.file-max。
+func (f *fdExhaustion) lowerFileMax() error {
+	fileMax, err := readProcSysUint(fileMaxPath, 0)
+	if err != nil {
+		return err
+	}
+	if f.fileMax >= fileMax {
+		return fmt.Errorf("file-max(%d) must be less than current value(%d)", f.fileMax, fileMax)
+	}
+	backup := fileMaxBackup{FileMax: strconv.FormatUint(fileMax, 10)}
+	if err := util.SaveState(f.FaultType, &backup); err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(fileMaxPath, []byte(strconv.FormatUint(f.fileMax, 10)), 0); err != nil {
+		return fmt.Errorf("write %d to %s failed: %v", f.fileMax, fileMaxPath, err)
+	}
+	return nil
+}
+
+// raiseNofileLimit 将自身的RLIMIT_NOFILE提高到能打开count个文件。
+func raiseNofileLimit(count uint64) error {
+	var limit unix.Rlimit
+	if err := unix.Getrlimit(unix.RLIMIT_NOFILE, &limit); err != nil {
+		return fmt.Errorf("get RLIMIT_NOFILE failed: %v", err)
+	}
+	if limit.Cur >= count {
+		return nil
+	}
+	limit.Cur = count
+	if limit.Max < count {
+		limit.Max = count
+	}
+	if err := unix.Setrlimit(unix.RLIMIT_NOFILE, &limit); err != nil {
+		return fmt.Errorf("raise RLIMIT_NOFILE to %d failed: %v", count, err)
+	}
+	return nil
+}
+
+// openFiles 持续打开/dev/null直到打开count个或打开失败，每次open都会占用一个内核file结构。
+func openFiles(count uint64) ([]int, error) {
+	var fds []int
+	for uint64(len(fds)) < count {
+		fd, err := unix.Open("/dev/null", unix.O_RDONLY|unix.O_CLOEXEC, 0)
+		if err != nil {
+			if err == syscall.EMFILE || err == syscall.ENFILE {
+				return fds, err
+			}
+			closeFiles(fds)
+			return nil, fmt.Errorf("open /dev/null failed: %v", err)
+		}
+		fds = append(fds, fd)
+	}
+	return fds, nil
+}
+
+func closeFiles(fds []int) {
+	for _, fd := range fds {
+		unix.Close(fd)
+	}
+}
+
+// tableResult 单个文件描述符表打开文件的结果。
+type tableResult struct {
+	count int
+	err   error
+}
+
+// openFilesInTable 在锁定的系统线程上通过unshare(CLONE_FILES)创建独立的文件描述符表并打开count个文件，
+// 直到releaseChan关闭后关闭文件，goroutine在锁定状态下退出时所在线程随之退出。
+func openFilesInTable(count uint64, resultChan chan<- tableResult, releaseChan <-chan struct{}) {
+	runtime.LockOSThread()
+	if err := unix.Unshare(unix.CLONE_FILES); err != nil {
+		resultChan <- tableResult{err: fmt.Errorf("unshare files failed: %v", err)}
+		return
+	}
+	fds, err := openFiles(count)
+	resultChan <- tableResult{count: len(fds), err: err}
+	<-releaseChan
+	closeFiles(fds)
+}
+
+// openSystemFds 打开文件直到已分配文件数达到fs.file-max的目标比例，返回打开的文件数，关闭releaseChan后释放。
+func (f *fdExhaustion) openSystemFds(releaseChan <-chan struct{}) (int, error) {
+	if f.fileMax != 0 {
+		if err := f.lowerFileMax(); err != nil {
+			return 0, err
+		}
+	}
+	need, err := f.needFds()
+	if err != nil {
+		return 0, err
+	}
+	maxFds, err := maxTableFds()
+	if err != nil {
+		return 0, err
+	}
+	if err := raiseNofileLimit(maxFds); err != nil {
+		return 0, err
+	}
+
+	opened := uint64(0)
+	resultChan := make(chan tableResult)
+	for opened < need {
+		count := maxFds - fdReserve
+		if need-opened < count {
+			count = need - opened
+		}
+		go openFilesInTable(count, resultChan, releaseChan)
+		result := <-resultChan
+		if result.count == 0 && result.err != nil {
+			return int(opened), result.err
+		}
+		opened += uint64(result.count)
+		// 打开失败说明已经达到系统上限。
+		if result.err != nil {
+			break
+		}
+	}
+	return int(opened), nil
+}
+
+// switchUser 将keeper切换为目标用户，保留saved uid为root以便退出前恢复身份删除keeper记录。
+// syscall包的Setresuid等函数同时修改所有线程的身份。
+func (f *fdExhaustion) switchUser() error {
+	if err := syscall.Setgroups(nil); err != nil {
+		return fmt.Errorf("set groups failed: %v", err)
+	}
+	if err := syscall.Setresgid(f.gid, f.gid, 0); err != nil {
+		return fmt.Errorf("set gid %d failed: %v", f.gid, err)
+	}
+	if err := syscall.Setresuid(f.uid, f.uid, 0); err != nil {
+		return fmt.Errorf("set uid %d failed: %v", f.uid, err)
+	}
+	return nil
+}
+
+// restoreRoot 恢复keeper的root身份。
+func restoreRoot() error {
+	if err := syscall.Setresuid(0, 0, 0); err != nil {
+		return fmt.Errorf("restore uid 0 failed: %v", err)
+	}
+	if err := syscall.Setresgid(0, 0, 0); err != nil {
+		return fmt.Errorf("restore gid 0 failed: %v", err)
+	}
+	return nil
+}
+
+// openUserFds 以目标用户身份打开文件直到耗尽RLIMIT_NOFILE，非root用户同时受fs.file-max限制。
+func (f *fdExhaustion) openUserFds() ([]int, error) {
+	var limit unix.Rlimit
+	if err := unix.Getrlimit(unix.RLIMIT_NOFILE, &limit); err != nil {
+		return nil, fmt.Errorf("get RLIMIT_NOFILE failed: %v", err)
+	}
+	if err := f.switchUser(); err != nil {
+		return nil, err
+	}
+	fds, err := openFiles(limit.Cur)
+	if fds == nil {
+		return nil, err
+	}
+	fmt.Printf("user %d opened %d files, RLIMIT_NOFILE: %d\n", f.uid, len(fds), limit.Cur)
+	return fds, nil
+}
+
+func (f *fdExhaustion) FaultInject(_ []string) error {
+	if util.KeeperIsRunning(f.keeperName()) || (f.mode == "system" && util.StateIsExist(f.FaultType)) {
+		return fmt.Errorf("%s fault has been injected", f.FaultType)
+	}
+	stopChan, err := util.StartKeeper(f.keeperName())
+	if err != nil {
+		return err
+	}
+	defer util.FinishKeeper(f.keeperName())
+
+	if f.mode == "user" {
+		defer restoreRoot()
+		fds, err := f.openUserFds()
+		if err != nil {
+			return err
+		}
+		defer closeFiles(fds)
+		<-stopChan
+		return nil
+	}
+
+	releaseChan := make(chan struct{})
+	defer close(releaseChan)
+	opened, err := f.openSystemFds(releaseChan)
+	if err != nil {
+		return err
+	}
+	allocated, _ := readProcSysUint(fileNrPath, 0)
+	fileMax, _ := readProcSysUint(fileMaxPath, 0)
+	fmt.Printf("opened %d files, file-nr: %d, file-max: %d\n", opened, allocated, fileMax)
+
+	<-stopChan
+	return nil
+}
+
+func (f *fdExhaustion) FaultRemove(_ []string) error {
+	if err := util.StopKeeper(f.keeperName()); err != nil {
+		return fmt.Errorf("remove %s failed: %v", f.FaultType, err)
+	}
+	if f.mode == "user" || !util.StateIsExist(f.FaultType) {
+		return nil
+	}
+
+	var backup fileMaxBackup
+	if err := util.LoadState(f.FaultType, &backup); err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(fileMaxPath, []byte(backup.FileMax), 0); err != nil {
+		return fmt.Errorf("write %s to %s failed: %v", backup.FileMax, fileMaxPath, err)
+	}
+	return util.RemoveState(f.FaultType)
+}
@@ -0,0 +1,368 @@
+/*
+Copyright 2023 Sangfor Technologies Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package system
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"runtime"
+	"runtime/debug"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"arsenal-os/internal/parse"
+	"arsenal-os/submodules"
+	"arsenal-os/util"
+
+	"golang.org/x/sys/unix"
+)
+
+func init() {
+	var newFaultType = pidExhaustion{
+		FaultType: "system-pid-exhaustion",
+	}
+	submodules.Add(newFaultType.FaultType, &newFaultType)
+}
+
+const (
+	pidMaxPath     = "/proc/sys/kernel/pid_max"
+	threadsMaxPath = "/proc/sys/kernel/threads-max"
+	loadAvgPath    = "/proc/loadavg"
+	// pidReserve 系统范围内至少保留的空闲pid数量，避免管理员无法登录清理故障。
+	pidReserve = 64
+	// goThreadHeadroom thread模式下为Go运行时保留的线程数量，运行时创建线程失败会直接退出。
+	goThreadHeadroom = 16
+	// pidExhaustionMaxCount 单次注入最多创建的线程或进程数量。
+	pidExhaustionMaxCount = 100000
+	// threadCost和processCost 每个线程或sleep进程大约占用的内存，包括内核栈和用户态栈。
+	threadCost  = 64 << 10
+	processCost = 1 << 20
+	// pidCheckInterval 每创建一定数量的任务重新检查系统空闲pid，其他进程可能同时在创建任务。
+	pidCheckInterval = 256
+)
+
+// pidExhaustion 通过创建阻塞的线程或sleep进程占用pid，系统范围的上限为pid_max和threads-max中较小的值，
+// 指定--cgroup时keeper迁移到该cgroup中，占用的是cgroup的pids.max。
+type pidExhaustion struct {
+	FaultType  string
+	flags      map[string]string
+	mode       string
+	percent    float64
+	maxCount   int
+	cgroupPath string
+}
+
+// systemTaskCount 返回系统当前的任务数量和上限，/proc/loadavg第4个字段为：运行任务数/总任务数。
+func systemTaskCount() (uint64, uint64, error) {
+	pidMax, err := readProcSysUint(pidMaxPath, 0)
+	if err != nil {
+		return 0, 0, err
+	}
+	threadsMax, err := readProcSysUint(threadsMaxPath, 0)
+	if err != nil {
+		return 0, 0, err
+	}
+	if threadsMax < pidMax {
+		pidMax = threadsMax
+	}
+
+	data, err := ioutil.ReadFile(loadAvgPath)
+	if err != nil {
+		return 0, 0, fmt.Errorf("read %s failed: %v", loadAvgPath, err)
+	}
+	fields := strings.Fields(string(data))
+	const tasksIndex = 3
+	if len(fields) <= tasksIndex || !strings.Contains(fields[tasksIndex], "/") {
+		return 0, 0, fmt.Errorf("invalid %s format", loadAvgPath)
+	}
+	current, err := strconv.ParseUint(strings.Split(fields[tasksIndex], "/")[1], 10, 64)
+	if err != nil {
+		return 0, 0, fmt.Errorf("trans task count to int failed: %v", err)
+	}
+	return current, pidMax, nil
+}
+
+// cgroupTaskCount 返回cgroup当前的任务数量和pids.max。
+func cgroupTaskCount(cgroupPath string) (uint64, uint64, error) {
+	maxStr, err := util.ReadCgroupFile(cgroupPath, "pids.max")
+	if err != nil {
+		return 0, 0, err
+	}
+	if maxStr == "max" {
+		return 0, 0, fmt.Errorf("pids.max of cgroup %s is not limited", cgroupPath)
+	}
+	limit, err := strconv.ParseUint(maxStr, 10, 64)
+	if err != nil {
+		return 0, 0, fmt.Errorf("trans pids.max to int failed: %v", err)
+	}
+	currentStr, err := util.ReadCgroupFile(cgroupPath, "pids.current")
+	if err != nil {
+		return 0, 0, err
+	}
+	current, err := strconv.ParseUint(currentStr, 10, 64)
+	if err != nil {
+		return 0, 0, fmt.Errorf("trans pids.current to int failed: %v", err)
+	}
+	return current, limit, nil
+}
+
+func (p *pidExhaustion) Prepare(inputArgs []string) error {
+	p.flags = parse.TransInputFlagsToMap(inputArgs)
+	if inputArgs[submodules.OpsTypeIndex] == submodules.Remove {
+		return nil
+	}
+
+	p.mode = "process"
+	if mode, ok := p.flags["mode"]; ok {
+		p.mode = mode
+	}
+	if p.mode != "process" && p.mode != "thread" {
+		return fmt.Errorf("invalid mode %s, example: process, thread", p.mode)
+	}
+	if p.mode == "process" {
+		if missingCmd, isMissCmd := util.CheckEnvShellCommand([]string{"sleep"}); isMissCmd {
+			return fmt.Errorf("missing command: %s", missingCmd)
+		}
+	}
+
+	percentStr, ok := p.flags["percent"]
+	if !ok {
+		return errors.New("please input param percent")
+	}
+	percent, err := strconv.ParseFloat(percentStr, 64)
+	if err != nil || percent <= 0 || percent > 100 {
+		return fmt.Errorf("percent param(%s) must be in range (0, 100]", percentStr)
+	}
+	p.percent = percent
+
+	p.maxCount = pidExhaustionMaxCount
+	if maxCountStr, ok := p.flags["max-count"]; ok {
+		maxCount, err := strconv.Atoi(maxCountStr)
+		if err != nil || maxCount <= 0 || maxCount > pidExhaustionMaxCount {
+			return fmt.Errorf("max-count param(%s) must be in range [1, %d]", maxCountStr, pidExhaustionMaxCount)
+		}
+		p.maxCount = maxCount
+	}
+
+	if cgroupPath, ok := p.flags["cgroup"]; ok {
+		fullPath, err := util.GetCgroupFullPath(cgroupPath, "pids")
+		if err != nil {
+			return fmt.Errorf("cgroup param error: %v", err)
+		}
+		if _, _, err := cgroupTaskCount(fullPath); err != nil {
+			return err
+		}
+		p.cgroupPath = fullPath
+	}
+
+	need, err := p.needTasks()
+	if err != nil {
+		return err
+	}
+	if need == 0 {
+		return fmt.Errorf("task count has already reached %.2f%% of the limit", p.percent)
+	}
+	// 限制创建的任务占用的内存，避免在耗尽pid前触发OOM killer。
+	available, err := util.GetMemInfoItem("MemAvailable")
+	if err != nil {
+		return err
+	}
+	cost := uint64(threadCost)
+	if p.mode == "process" {
+		cost = processCost
+	}
+	if need*cost > available/2 {
+		return fmt.Errorf("%d tasks in %s mode need about %s memory, more than half of available memory(%s)",
+			need, p.mode, util.FormatSize(need*cost), util.FormatSize(available))
+	}
+	return nil
+}
+
+// needTasks 计算达到目标比例还需要创建的任务数量，并保证不超过安全限制。
+func (p *pidExhaustion) needTasks() (uint64, error) {
+	current, limit, err := systemTaskCount()
+	if err != nil {
+		return 0, err
+	}
+	if limit <= current+pidReserve {
+		return 0, nil
+	}
+	// 系统范围内始终保留pidReserve个空闲pid。
+	need := limit - current - pidReserve
+	if target := uint64(float64(limit) * p.percent / 100); target <= current {
+		need = 0
+	} else if target-current < need {
+		need = target - current
+	}
+
+	if p.cgroupPath != "" {
+		current, limit, err := cgroupTaskCount(p.cgroupPath)
+		if err != nil {
+			return 0, err
+		}
+		cgroupNeed := uint64(0)
+		if target := uint64(float64(limit) * p.percent / 100); target > current {
+			cgroupNeed = target - current
+		}
+		if cgroupNeed < need {
+			need = cgroupNeed
+		}
+	}
+
+	if p.mode == "thread" {
+		if need <= goThreadHeadroom {
+			return 0, nil
+		}
+		need -= goThreadHeadroom
+	}
+	if need > uint64(p.maxCount) {
+		need = uint64(p.maxCount)
+	}
+	return need, nil
+}
+
+// spawnThreads 创建最多count个锁定在独立系统线程上并阻塞在管道读的goroutine，keeper退出时线程随之退出。
+func spawnThreads(count uint64, checkFunc func() bool) (int, error) {
+	var pipeFds [2]int
+	if err := unix.Pipe2(pipeFds[:], unix.O_CLOEXEC); err != nil {
+		return 0, fmt.Errorf("create pipe failed: %v", err)
+	}
+	// 默认最多10000个线程，超过后运行时直接退出。
+	debug.SetMaxThreads(int(count) + 10000)
+	started := make(chan struct{})
+	for index := uint64(0); index < count; index++ {
+		if index%pidCheckInterval == 0 && index != 0 && !checkFunc() {
+			fmt.Printf("free pids are less than %d, stop creating threads\n", pidReserve)
+			return int(index), nil
+		}
+		go func() {
+			runtime.LockOSThread()
+			started <- struct{}{}
+			buf := make([]byte, 1)
+			unix.Read(pipeFds[0], buf)
+		}()
+		<-started
+	}
+	return int(count), nil
+}
+
+// spawnProcesses 创建最多count个位于同一进程组的sleep进程，fork失败时停止创建。
+// Pdeathsig在创建子进程的系统线程退出时触发，调用者需要在子进程存活期间将goroutine锁定在当前线程。
+func spawnProcesses(count uint64, checkFunc func() bool) ([]*exec.Cmd, error) {
+	sleepPath, err := exec.LookPath("sleep")
+	if err != nil {
+		return nil, fmt.Errorf("look path of sleep failed: %v", err)
+	}
+	var children []*exec.Cmd
+	pgid := 0
+	for index := uint64(0); index < count; index++ {
+		if index%pidCheckInterval == 0 && index != 0 && !checkFunc() {
+			fmt.Printf("free pids are less than %d, stop creating processes\n", pidReserve)
+			break
+		}
+		child := exec.Command(sleepPath, util.SleepForever)
+		// keeper被强制杀死时子进程收到SIGKILL，避免遗留大量sleep进程，正常退出时由reapProcesses按进程组清理。
+		child.SysProcAttr = &syscall.SysProcAttr{Setpgid: true, Pgid: pgid, Pdeathsig: syscall.SIGKILL}
+		if err := child.Start(); err != nil {
+			fmt.Printf("create process failed: %v\n", err)
+			break
+		}
+		if pgid == 0 {
+			pgid = child.Process.Pid
+		}
+		children = append(children, child)
+	}
+	return children, nil
+}
+
+// reapProcesses 杀死整个进程组并回收所有子进程。
+func reapProcesses(children []*exec.Cmd) {
+	if len(children) == 0 {
+		return
+	}
+	syscall.Kill(-children[0].Process.Pid, syscall.SIGKILL)
+	for _, child := range children {
+		child.Process.Kill()
+		child.Wait()
+	}
+}
+
+// hasFreePids 判断系统空闲pid是否多于保留数量。
+func hasFreePids() bool {
+	current, limit, err := systemTaskCount()
+	return err == nil && limit > current+pidReserve
+}
+
+func (p *pidExhaustion) FaultInject(_ []string) error {
+	if util.KeeperIsRunning(p.FaultType) {
+		return fmt.Errorf("%s fault has been injected", p.FaultType)
+	}
+	stopChan, err := util.StartKeeper(p.FaultType)
+	if err != nil {
+		return err
+	}
+	defer util.FinishKeeper(p.FaultType)
+
+	// 创建的线程和进程计入目标cgroup的pids.current。
+	if p.cgroupPath != "" {
+		if err := util.MoveProcessToCgroup(os.Getpid(), p.cgroupPath); err != nil {
+			return err
+		}
+	}
+	need, err := p.needTasks()
+	if err != nil {
+		return err
+	}
+
+	created := 0
+	if p.mode == "thread" {
+		if created, err = spawnThreads(need, hasFreePids); err != nil {
+			return err
+		}
+	} else {
+		// 运行时可能回收空闲的系统线程，锁定线程直到子进程被回收，避免Pdeathsig提前杀死子进程。
+		runtime.LockOSThread()
+		defer runtime.UnlockOSThread()
+		children, err := spawnProcesses(need, hasFreePids)
+		defer reapProcesses(children)
+		if err != nil {
+			return err
+		}
+		created = len(children)
+	}
+
+	current, limit, _ := systemTaskCount()
+	fmt.Printf("created %d tasks in %s mode, system tasks: %d, limit: %d\n", created, p.mode, current, limit)
+	if p.cgroupPath != "" {
+		current, limit, _ := cgroupTaskCount(p.cgroupPath)
+		fmt.Printf("cgroup %s pids.current: %d, pids.max: %d\n", p.cgroupPath, current, limit)
+	}
+
+	<-stopChan
+	return nil
+}
+
+func (p *pidExhaustion) FaultRemove(_ []string) error {
+	if err := util.StopKeeper(p.FaultType); err != nil {
+		return fmt.Errorf("remove %s failed: %v", p.FaultType, err)
+	}
+	return nil
+}
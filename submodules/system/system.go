@@ -26,7 +26,7 @@ import (
 	"arsenal-os/util"
 )
 
-var Trigger = "/proc/sysrq-trigger"
+var Trigger = util.SysrqTriggerPath
 
 func triggerRunEnvChecker() error {
 	if missingCmd, isMissCmd := util.CheckEnvShellCommand([]string{"echo"}); isMissCmd {
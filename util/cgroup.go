@@ -0,0 +1,117 @@
+/*
+Copyright 2023 Sangfor Technologies Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package util
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// CgroupRoot cgroup文件系统的挂载点。
+const CgroupRoot = "/sys/fs/cgroup"
+
+// IsCgroupV2 判断系统是否使用cgroup v2统一层级。
+func IsCgroupV2() bool {
+	return FileIsExist(filepath.Join(CgroupRoot, "cgroup.controllers"))
+}
+
+// GetCgroupFullPath 获取cgroup目录的全路径，cgroupPath可以是全路径或相对于cgroup层级根目录的路径，
+// cgroup v1需要通过controller指定层级，如：memory。
+func GetCgroupFullPath(cgroupPath, controller string) (string, error) {
+	var fullPath string
+	switch {
+	case strings.HasPrefix(cgroupPath, CgroupRoot+"/"):
+		fullPath = filepath.Clean(cgroupPath)
+	case IsCgroupV2():
+		fullPath = filepath.Join(CgroupRoot, cgroupPath)
+	default:
+		fullPath = filepath.Join(CgroupRoot, controller, cgroupPath)
+	}
+	if !FileIsExist(filepath.Join(fullPath, "cgroup.procs")) {
+		return "", fmt.Errorf("%s is not a cgroup directory", fullPath)
+	}
+	return fullPath, nil
+}
+
+// MoveProcessToCgroup 将进程的所有线程迁移到cgroup中。
+func MoveProcessToCgroup(pid int, cgroupFullPath string) error {
+	procsPath := filepath.Join(cgroupFullPath, "cgroup.procs")
+	if err := ioutil.WriteFile(procsPath, []byte(strconv.Itoa(pid)), 0); err != nil {
+		return fmt.Errorf("move process %d to cgroup %s failed: %v", pid, cgroupFullPath, err)
+	}
+	return nil
+}
+
+// GetProcessCgroupPath 解析/proc/<pid>/cgroup获取进程所在cgroup目录的全路径，
+// cgroup v1需要通过controller指定层级，如：memory、freezer。
+func GetProcessCgroupPath(pid int, controller string) (string, error) {
+	cgroupFile := fmt.Sprintf("/proc/%d/cgroup", pid)
+	file, err := os.Open(cgroupFile)
+	if err != nil {
+		return "", fmt.Errorf("open %s failed: %v", cgroupFile, err)
+	}
+	defer file.Close()
+
+	isV2 := IsCgroupV2()
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		// 行格式为：hierarchy-ID:controller-list:cgroup-path，cgroup v2的行为：0::/path。
+		fields := strings.SplitN(scanner.Text(), ":", 3)
+		if len(fields) != 3 {
+			continue
+		}
+		if isV2 {
+			if fields[0] == "0" && fields[1] == "" {
+				return filepath.Join(CgroupRoot, fields[2]), nil
+			}
+			continue
+		}
+		for _, name := range strings.Split(fields[1], ",") {
+			if name == controller {
+				return filepath.Join(CgroupRoot, fields[1], fields[2]), nil
+			}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return "", fmt.Errorf("read %s failed: %v", cgroupFile, err)
+	}
+	return "", fmt.Errorf("can not found %s cgroup of process %d", controller, pid)
+}
+
+// ReadCgroupFile 读取cgroup控制文件的内容并去除首尾空白。
+func ReadCgroupFile(cgroupFullPath, name string) (string, error) {
+	path := filepath.Join(cgroupFullPath, name)
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", fmt.Errorf("read %s failed: %v", path, err)
+	}
+	return strings.TrimSpace(string(data)), nil
+}
+
+// WriteCgroupFile 写cgroup控制文件。
+func WriteCgroupFile(cgroupFullPath, name, value string) error {
+	path := filepath.Join(cgroupFullPath, name)
+	if err := ioutil.WriteFile(path, []byte(value), 0); err != nil {
+		return fmt.Errorf("write %s to %s failed: %v", value, path, err)
+	}
+	return nil
+}
@@ -0,0 +1,133 @@
+/*
+Copyright 2023 Sangfor Technologies Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package util
+
+import (
+	"fmt"
+	"io/ioutil"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+func isDuplicateCPUID(cpuList []int, checkID int64) bool {
+	for _, id := range cpuList {
+		if id == int(checkID) {
+			return true
+		}
+	}
+	return false
+}
+
+// ParseCPUList 解析cpu-list格式的字符串，如：0-3,5,7-8，返回cpu id列表。
+func ParseCPUList(cpuListString string) ([]int, error) {
+	re := regexp.MustCompile(`^(\d+(-\d+)?)(,\d+(-\d+)?)*$`)
+	if !re.MatchString(cpuListString) {
+		return nil, fmt.Errorf("cpu list format error: %s", cpuListString)
+	}
+
+	var cpuList []int
+	// 将字符串按逗号分隔成多个子串。
+	parts := strings.Split(cpuListString, ",")
+	for _, part := range parts {
+		// 判断子串中是否包含连字符。
+		if strings.Contains(part, "-") {
+			// 将子串按连字符分隔成两个数字。
+			rangeParts := strings.Split(part, "-")
+			start, err := strconv.ParseInt(rangeParts[0], 10, 64)
+			if err != nil {
+				return nil, fmt.Errorf("trans cpu range starting id to int failed: %v", err)
+			}
+			end, err := strconv.ParseInt(rangeParts[1], 10, 64)
+			if err != nil {
+				return nil, fmt.Errorf("trans cpu range ending id to int failed: %v", err)
+			}
+			if start > end {
+				return nil, fmt.Errorf("cpu range starting id is larger than ending id: %s", part)
+			}
+			// 将两个数字之间的所有整数加入数组。
+			for i := start; i <= end; i++ {
+				if isDuplicateCPUID(cpuList, i) {
+					return nil, fmt.Errorf("duplicate cpu id: %d", i)
+				}
+				cpuList = append(cpuList, int(i))
+			}
+		} else {
+			// 将子串转换为整数并加入数组。
+			num, err := strconv.ParseInt(part, 10, 64)
+			if err != nil {
+				return nil, fmt.Errorf("trans single cpu id string to int failed: %v", err)
+			}
+			if isDuplicateCPUID(cpuList, num) {
+				return nil, fmt.Errorf("duplicate cpu id: %d", num)
+			}
+			cpuList = append(cpuList, int(num))
+		}
+	}
+	return cpuList, nil
+}
+
+// FormatCPUList 将cpu id列表转换成cpu-list格式的字符串，连续的id合并为区间，如：0-3,5。
+func FormatCPUList(cpuList []int) string {
+	sorted := make([]int, len(cpuList))
+	copy(sorted, cpuList)
+	sort.Ints(sorted)
+
+	var parts []string
+	for index := 0; index < len(sorted); {
+		end := index
+		for end+1 < len(sorted) && sorted[end+1] == sorted[end]+1 {
+			end++
+		}
+		if end == index {
+			parts = append(parts, strconv.Itoa(sorted[index]))
+		} else {
+			parts = append(parts, fmt.Sprintf("%d-%d", sorted[index], sorted[end]))
+		}
+		index = end + 1
+	}
+	return strings.Join(parts, ",")
+}
+
+// GetOnlineCPUList 获取当前处于online状态的cpu id列表。
+func GetOnlineCPUList() ([]int, error) {
+	const onlineCPUPath = "/sys/devices/system/cpu/online"
+	data, err := ioutil.ReadFile(onlineCPUPath)
+	if err != nil {
+		return nil, fmt.Errorf("read %s failed: %v", onlineCPUPath, err)
+	}
+	return ParseCPUList(strings.TrimSpace(string(data)))
+}
+
+// CheckCPUListOnline 检查cpu列表中的cpu是否都处于online状态。
+func CheckCPUListOnline(cpuList []int) error {
+	onlineCPUList, err := GetOnlineCPUList()
+	if err != nil {
+		return err
+	}
+	onlineCPUs := make(map[int]bool, len(onlineCPUList))
+	for _, cpuID := range onlineCPUList {
+		onlineCPUs[cpuID] = true
+	}
+	for _, cpuID := range cpuList {
+		if !onlineCPUs[cpuID] {
+			return fmt.Errorf("cpu %d is not online", cpuID)
+		}
+	}
+	return nil
+}
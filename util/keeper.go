@@ -0,0 +1,142 @@
+/*
+Copyright 2023 Sangfor Technologies Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package util
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// keeper是需要持续维持故障现场的注入进程(如持续占用内存)，注入进程本身常驻后台，
+// 启动时将自身pid登记到状态记录中，清理进程通过登记记录找到keeper并停止它。
+
+const (
+	// keeperStopTimeout 等待keeper收到SIGTERM后自行退出的超时时间。
+	keeperStopTimeout = 10 * time.Second
+	// keeperPollInterval 等待keeper退出时的检查间隔。
+	keeperPollInterval = 100 * time.Millisecond
+)
+
+// keeperRecord keeper进程的登记信息，cmdline用于防止pid被复用后误杀其他进程。
+type keeperRecord struct {
+	Pid     int
+	Cmdline string
+}
+
+func keeperStateName(name string) string {
+	return fmt.Sprintf("%s-keeper", name)
+}
+
+// GetProcessCmdline 获取进程的启动命令，参数之间以空格分隔，僵尸进程返回空字符串。
+func GetProcessCmdline(pid int) (string, error) {
+	data, err := ioutil.ReadFile(fmt.Sprintf("/proc/%d/cmdline", pid))
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(strings.ReplaceAll(string(data), "\x00", " ")), nil
+}
+
+func (k *keeperRecord) isAlive() bool {
+	cmdline, err := GetProcessCmdline(k.Pid)
+	return err == nil && cmdline != "" && cmdline == k.Cmdline
+}
+
+// KeeperIsRunning 判断名称为name的keeper是否仍在运行。
+func KeeperIsRunning(name string) bool {
+	var record keeperRecord
+	if err := LoadState(keeperStateName(name), &record); err != nil {
+		return false
+	}
+	return record.isAlive()
+}
+
+// StartKeeper 将当前进程登记为名称为name的keeper，返回的channel在收到SIGTERM或SIGINT时可读，
+// keeper收到信号后应释放占用的资源并调用FinishKeeper退出。
+func StartKeeper(name string) (<-chan os.Signal, error) {
+	if KeeperIsRunning(name) {
+		return nil, fmt.Errorf("keeper %s is already running", name)
+	}
+
+	pid := os.Getpid()
+	cmdline, err := GetProcessCmdline(pid)
+	if err != nil {
+		return nil, fmt.Errorf("get keeper %s cmdline failed: %v", name, err)
+	}
+	// 先注册信号处理再登记，避免清理进程在登记后、注册前发送信号导致keeper直接退出。
+	stopChan := make(chan os.Signal, 1)
+	signal.Notify(stopChan, syscall.SIGTERM, syscall.SIGINT)
+	if err := SaveState(keeperStateName(name), &keeperRecord{Pid: pid, Cmdline: cmdline}); err != nil {
+		signal.Stop(stopChan)
+		return nil, err
+	}
+	return stopChan, nil
+}
+
+// FinishKeeper keeper退出前删除自身的登记记录。
+func FinishKeeper(name string) error {
+	var record keeperRecord
+	if err := LoadState(keeperStateName(name), &record); err != nil {
+		return nil
+	}
+	if record.Pid != os.Getpid() {
+		return nil
+	}
+	return RemoveState(keeperStateName(name))
+}
+
+// StopKeeper 向名称为name的keeper发送SIGTERM并等待其退出，超时后发送SIGKILL，
+// keeper已经退出时直接删除登记记录。
+func StopKeeper(name string) error {
+	var record keeperRecord
+	if !StateIsExist(keeperStateName(name)) {
+		return nil
+	}
+	if err := LoadState(keeperStateName(name), &record); err != nil {
+		return err
+	}
+
+	if record.isAlive() {
+		if err := syscall.Kill(record.Pid, syscall.SIGTERM); err != nil && err != syscall.ESRCH {
+			return fmt.Errorf("send SIGTERM to keeper %s(%d) failed: %v", name, record.Pid, err)
+		}
+		if !waitKeeperExit(&record, keeperStopTimeout) {
+			if err := syscall.Kill(record.Pid, syscall.SIGKILL); err != nil && err != syscall.ESRCH {
+				return fmt.Errorf("send SIGKILL to keeper %s(%d) failed: %v", name, record.Pid, err)
+			}
+			if !waitKeeperExit(&record, keeperStopTimeout) {
+				return fmt.Errorf("keeper %s(%d) is still running", name, record.Pid)
+			}
+		}
+	}
+	return RemoveState(keeperStateName(name))
+}
+
+func waitKeeperExit(record *keeperRecord, timeout time.Duration) bool {
+	deadline := time.Now().Add(timeout)
+	for time.Now().Before(deadline) {
+		if !record.isAlive() {
+			return true
+		}
+		time.Sleep(keeperPollInterval)
+	}
+	return !record.isAlive()
+}
@@ -0,0 +1,72 @@
+/*
+Copyright 2023 Sangfor Technologies Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package util
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+const procMemInfoPath = "/proc/meminfo"
+
+// ReadMemInfo 解析/proc/meminfo，返回各字段的值，带kB单位的字段转换成字节，
+// 如：map[MemTotal:8010072064 MemAvailable:5214711808 HugePages_Free:0]。
+func ReadMemInfo() (map[string]uint64, error) {
+	file, err := os.Open(procMemInfoPath)
+	if err != nil {
+		return nil, fmt.Errorf("open %s failed: %v", procMemInfoPath, err)
+	}
+	defer file.Close()
+
+	memInfo := make(map[string]uint64)
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		// 行格式为：MemTotal:        7822336 kB。
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 2 {
+			continue
+		}
+		value, err := strconv.ParseUint(fields[1], 10, 64)
+		if err != nil {
+			continue
+		}
+		if len(fields) == 3 && fields[2] == "kB" {
+			value *= kib
+		}
+		memInfo[strings.TrimSuffix(fields[0], ":")] = value
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("read %s failed: %v", procMemInfoPath, err)
+	}
+	return memInfo, nil
+}
+
+// GetMemInfoItem 获取/proc/meminfo中单个字段的值。
+func GetMemInfoItem(name string) (uint64, error) {
+	memInfo, err := ReadMemInfo()
+	if err != nil {
+		return 0, err
+	}
+	value, ok := memInfo[name]
+	if !ok {
+		return 0, fmt.Errorf("can not found %s in %s", name, procMemInfoPath)
+	}
+	return value, nil
+}
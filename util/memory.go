@@ -0,0 +1,99 @@
+/*
+Copyright 2023 Sangfor Technologies Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package util
+
+import (
+	"fmt"
+
+	"golang.org/x/sys/unix"
+)
+
+// DefaultMemoryChunkSize 匿名内存按块申请和释放的默认大小。
+const DefaultMemoryChunkSize = 16 * mib
+
+// AnonMemory 通过mmap申请的匿名内存块集合，用于在进程内持续占用物理内存，
+// 内存不经过go runtime管理，释放后立即归还给系统。
+type AnonMemory struct {
+	// ChunkSize 每个内存块的大小，为0时使用DefaultMemoryChunkSize。
+	ChunkSize uint64
+	// Locked 为true时通过mlock锁定内存，锁定的内存不会被回收或换出到swap。
+	Locked bool
+	chunks [][]byte
+	size   uint64
+}
+
+func (a *AnonMemory) chunkSize() uint64 {
+	if a.ChunkSize == 0 {
+		return DefaultMemoryChunkSize
+	}
+	return a.ChunkSize
+}
+
+// Size 返回当前占用的内存大小，单位为字节。
+func (a *AnonMemory) Size() uint64 {
+	return a.size
+}
+
+// Grow 按块增加占用size字节的内存(向上取整到块大小)，每页都会写入数据保证分配物理内存。
+func (a *AnonMemory) Grow(size uint64) error {
+	chunkSize := a.chunkSize()
+	for grown := uint64(0); grown < size; grown += chunkSize {
+		chunk, err := unix.Mmap(-1, 0, int(chunkSize), unix.PROT_READ|unix.PROT_WRITE,
+			unix.MAP_PRIVATE|unix.MAP_ANONYMOUS|unix.MAP_POPULATE)
+		if err != nil {
+			return fmt.Errorf("mmap %s anonymous memory failed: %v", FormatSize(chunkSize), err)
+		}
+		// MAP_POPULATE在内存紧张时不保证预分配成功，逐页写入确保内存真实占用。
+		pageSize := unix.Getpagesize()
+		for offset := 0; offset < len(chunk); offset += pageSize {
+			chunk[offset] = 1
+		}
+		if a.Locked {
+			if err := unix.Mlock(chunk); err != nil {
+				unix.Munmap(chunk)
+				return fmt.Errorf("mlock %s anonymous memory failed: %v", FormatSize(chunkSize), err)
+			}
+		}
+		a.chunks = append(a.chunks, chunk)
+		a.size += chunkSize
+	}
+	return nil
+}
+
+// Shrink 按块释放size字节的内存(向下取整到块大小)。
+func (a *AnonMemory) Shrink(size uint64) error {
+	chunkSize := a.chunkSize()
+	for shrunk := uint64(0); shrunk+chunkSize <= size && len(a.chunks) != 0; shrunk += chunkSize {
+		last := len(a.chunks) - 1
+		if a.Locked {
+			if err := unix.Munlock(a.chunks[last]); err != nil {
+				return fmt.Errorf("munlock anonymous memory failed: %v", err)
+			}
+		}
+		if err := unix.Munmap(a.chunks[last]); err != nil {
+			return fmt.Errorf("munmap anonymous memory failed: %v", err)
+		}
+		a.chunks = a.chunks[:last]
+		a.size -= chunkSize
+	}
+	return nil
+}
+
+// Release 释放所有占用的内存。
+func (a *AnonMemory) Release() error {
+	return a.Shrink(a.size)
+}
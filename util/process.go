@@ -0,0 +1,155 @@
+/*
+Copyright 2023 Sangfor Technologies Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package util
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// /proc/<pid>/stat中进程名之后的字段下标，字段从第3个(state)开始，ppid为第4个，starttime为第22个。
+const (
+	statPpidIndex      = 1
+	statStartTimeIndex = 19
+)
+
+// ProcessIsExist 检查进程是否存在。
+func ProcessIsExist(pid int) bool {
+	return FileIsExist(fmt.Sprintf("/proc/%d", pid))
+}
+
+// GetProcessPidAndExistCheck 检查输入参数pid对应进程是否存在。
+func GetProcessPidAndExistCheck(flagsMap map[string]string) (int, error) {
+	if _, ok := flagsMap["pid"]; !ok {
+		return -1, errors.New("please input params: pid")
+	}
+	pid, err := strconv.Atoi(flagsMap["pid"])
+	if err != nil {
+		return -1, fmt.Errorf("trans pid string to int failed: %v", err)
+	}
+	if !ProcessIsExist(pid) {
+		return pid, fmt.Errorf("the process: %d does not exist", pid)
+	}
+	return pid, nil
+}
+
+// GetProcessThreadIDs 获取进程下所有线程的tid。
+func GetProcessThreadIDs(pid int) ([]int, error) {
+	taskDir := fmt.Sprintf("/proc/%d/task", pid)
+	taskList, err := ioutil.ReadDir(taskDir)
+	if err != nil {
+		return nil, fmt.Errorf("read %s failed: %v", taskDir, err)
+	}
+
+	tids := make([]int, 0, len(taskList))
+	for _, task := range taskList {
+		tid, err := strconv.Atoi(task.Name())
+		if err != nil {
+			continue
+		}
+		tids = append(tids, tid)
+	}
+	return tids, nil
+}
+
+// getProcessTgid 获取线程所属线程组的id，即进程pid。
+func getProcessTgid(tid int) (int, error) {
+	statusPath := fmt.Sprintf("/proc/%d/status", tid)
+	data, err := ioutil.ReadFile(statusPath)
+	if err != nil {
+		return -1, fmt.Errorf("read %s failed: %v", statusPath, err)
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		if !strings.HasPrefix(line, "Tgid:") {
+			continue
+		}
+		tgid, err := strconv.Atoi(strings.TrimSpace(strings.TrimPrefix(line, "Tgid:")))
+		if err != nil {
+			return -1, fmt.Errorf("trans %s tgid to int failed: %v", statusPath, err)
+		}
+		return tgid, nil
+	}
+	return -1, fmt.Errorf("can't found Tgid in %s", statusPath)
+}
+
+// getProcessPidList 解析以逗号分隔的pid参数，线程id转换为所属进程的pid并去重。
+func getProcessPidList(flagsMap map[string]string) ([]int, error) {
+	pidStr, ok := flagsMap["pid"]
+	if !ok {
+		return nil, errors.New("please input params: pid")
+	}
+
+	var pids []int
+	isExist := make(map[int]bool)
+	for _, str := range strings.Split(pidStr, ",") {
+		tid, err := strconv.Atoi(str)
+		if err != nil {
+			return nil, fmt.Errorf("trans pid string to int failed: %v", err)
+		}
+		if !ProcessIsExist(tid) {
+			return nil, fmt.Errorf("the process: %d does not exist", tid)
+		}
+		pid, err := getProcessTgid(tid)
+		if err != nil {
+			return nil, err
+		}
+		if pid == os.Getpid() {
+			return nil, fmt.Errorf("the process: %d is arsenal-os itself", pid)
+		}
+		if !isExist[pid] {
+			isExist[pid] = true
+			pids = append(pids, pid)
+		}
+	}
+	return pids, nil
+}
+
+// readProcessStat 读取/proc/<pid>/stat，返回进程名和进程名之后的字段。
+func readProcessStat(pid int) (string, []string, error) {
+	data, err := ioutil.ReadFile(fmt.Sprintf("/proc/%d/stat", pid))
+	if err != nil {
+		return "", nil, err
+	}
+	// 进程名中可能包含空格和括号，以最后一个')'分隔进程名和其余字段。
+	stat := string(data)
+	commStart, commEnd := strings.IndexByte(stat, '('), strings.LastIndexByte(stat, ')')
+	if commStart < 0 || commEnd < commStart {
+		return "", nil, fmt.Errorf("invalid /proc/%d/stat format", pid)
+	}
+	fields := strings.Fields(stat[commEnd+1:])
+	if len(fields) <= statStartTimeIndex {
+		return "", nil, fmt.Errorf("invalid /proc/%d/stat format", pid)
+	}
+	return stat[commStart+1 : commEnd], fields, nil
+}
+
+// GetProcessStartTime 获取进程的启动时间，pid和启动时间唯一标识一个进程，用于防止pid被复用后误操作其他进程。
+func GetProcessStartTime(pid int) (uint64, error) {
+	_, fields, err := readProcessStat(pid)
+	if err != nil {
+		return 0, err
+	}
+	startTime, err := strconv.ParseUint(fields[statStartTimeIndex], 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("trans process %d starttime to int failed: %v", pid, err)
+	}
+	return startTime, nil
+}
@@ -0,0 +1,66 @@
+/*
+Copyright 2023 Sangfor Technologies Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package util
+
+import (
+	"fmt"
+
+	"golang.org/x/sys/unix"
+)
+
+// ProcessRlimit 进程修改前的资源限制，StartTime用于恢复时识别pid是否被复用。
+type ProcessRlimit struct {
+	StartTime uint64
+	Limit     unix.Rlimit
+}
+
+// RlimitBackup 记录各进程修改前的资源限制，key为pid。
+type RlimitBackup struct {
+	Resource int
+	Limits   map[int]ProcessRlimit
+}
+
+// NewRlimitBackup 获取各进程当前的资源限制。
+func NewRlimitBackup(pids []int, resource int) (*RlimitBackup, error) {
+	backup := RlimitBackup{Resource: resource, Limits: make(map[int]ProcessRlimit, len(pids))}
+	for _, pid := range pids {
+		startTime, err := GetProcessStartTime(pid)
+		if err != nil {
+			return nil, err
+		}
+		var limit unix.Rlimit
+		if err := unix.Prlimit(pid, resource, nil, &limit); err != nil {
+			return nil, fmt.Errorf("get process %d resource %d limit failed: %v", pid, resource, err)
+		}
+		backup.Limits[pid] = ProcessRlimit{StartTime: startTime, Limit: limit}
+	}
+	return &backup, nil
+}
+
+// Restore 恢复各进程的资源限制，进程可能已经退出，或pid已经被重启后的其他进程复用。
+func (b *RlimitBackup) Restore() error {
+	for pid, old := range b.Limits {
+		if startTime, err := GetProcessStartTime(pid); err != nil || startTime != old.StartTime {
+			continue
+		}
+		limit := old.Limit
+		if err := unix.Prlimit(pid, b.Resource, &limit, nil); err != nil && err != unix.ESRCH {
+			return fmt.Errorf("restore process %d resource %d limit failed: %v", pid, b.Resource, err)
+		}
+	}
+	return nil
+}
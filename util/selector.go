@@ -0,0 +1,317 @@
+/*
+Copyright 2023 Sangfor Technologies Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package util
+
+import (
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"os/user"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// 目标选择器通过进程名、启动命令、用户、cgroup、systemd服务或父进程筛选故障注入目标，
+// 避免场景文件依赖每次重启都会变化的pid。
+
+var (
+	// selectorFlags 所有用于选择目标进程的参数。
+	selectorFlags   = []string{"pid", "name", "cmdline-regex", "user", "cgroup", "unit", "ppid", "select", "count"}
+	validSelectMode = []string{"all", "one", "random", "oldest", "newest"}
+)
+
+// ProcessSelector 按进程名、启动命令、用户、cgroup、systemd服务或父进程筛选进程。
+type ProcessSelector struct {
+	name         string
+	cmdlineRegex *regexp.Regexp
+	uid          string
+	cgroup       string
+	unit         string
+	ppid         string
+	selectMode   string
+	count        int
+}
+
+// ProcessInfo 选择目标进程时需要的进程属性。
+type ProcessInfo struct {
+	Pid       int
+	Ppid      string
+	Comm      string
+	Cmdline   string
+	UID       string
+	StartTime uint64
+	Cgroups   []string
+}
+
+// SelectorStateName 根据选择参数生成注入记录的名称，清理时使用相同的参数即可找到注入记录。
+func SelectorStateName(faultType string, flagsMap map[string]string) string {
+	hash := fnv.New32a()
+	for _, name := range selectorFlags {
+		if value, ok := flagsMap[name]; ok {
+			fmt.Fprintf(hash, "%s=%s;", name, value)
+		}
+	}
+	return fmt.Sprintf("%s-%08x", faultType, hash.Sum32())
+}
+
+// NewProcessSelector 解析选择参数，未指定任何筛选条件时返回错误。
+func NewProcessSelector(flagsMap map[string]string) (*ProcessSelector, error) {
+	selector := ProcessSelector{
+		name:       flagsMap["name"],
+		cgroup:     flagsMap["cgroup"],
+		unit:       flagsMap["unit"],
+		ppid:       flagsMap["ppid"],
+		selectMode: "all",
+		count:      1,
+	}
+	if regexStr, ok := flagsMap["cmdline-regex"]; ok {
+		cmdlineRegex, err := regexp.Compile(regexStr)
+		if err != nil {
+			return nil, fmt.Errorf("compile cmdline-regex(%s) failed: %v", regexStr, err)
+		}
+		selector.cmdlineRegex = cmdlineRegex
+	}
+	if userStr, ok := flagsMap["user"]; ok {
+		// 优先按用户名查找，不存在时按uid查找。
+		userInfo, err := user.Lookup(userStr)
+		if err != nil {
+			if userInfo, err = user.LookupId(userStr); err != nil {
+				return nil, fmt.Errorf("lookup user %s failed: %v", userStr, err)
+			}
+		}
+		selector.uid = userInfo.Uid
+	}
+	if selector.unit != "" && filepath.Ext(selector.unit) == "" {
+		selector.unit += ".service"
+	}
+	if selector.ppid != "" {
+		if _, err := strconv.Atoi(selector.ppid); err != nil {
+			return nil, fmt.Errorf("trans ppid string to int failed: %v", err)
+		}
+	}
+	if selector.name == "" && selector.cmdlineRegex == nil && selector.uid == "" && selector.cgroup == "" &&
+		selector.unit == "" && selector.ppid == "" {
+		return nil, errors.New("please input params: pid, name, cmdline-regex, user, cgroup, unit or ppid")
+	}
+
+	if selectMode, ok := flagsMap["select"]; ok {
+		selector.selectMode = selectMode
+	}
+	if !IsValidValue(selector.selectMode, validSelectMode) {
+		return nil, fmt.Errorf("invalid select %s, example: %s", selector.selectMode, validSelectMode)
+	}
+	if countStr, ok := flagsMap["count"]; ok {
+		// all和one选择所有匹配的进程，count不生效，直接拒绝避免误解。
+		if selector.selectMode == "all" || selector.selectMode == "one" {
+			return nil, fmt.Errorf("count is not supported when select is %s, please use random, oldest or newest",
+				selector.selectMode)
+		}
+		count, err := strconv.Atoi(countStr)
+		if err != nil || count <= 0 {
+			return nil, fmt.Errorf("count param(%s) must be a positive integer", countStr)
+		}
+		selector.count = count
+	}
+	return &selector, nil
+}
+
+// ReadProcessInfo 读取进程属性，内核线程和僵尸进程没有启动命令，返回nil。
+func ReadProcessInfo(pid int) (*ProcessInfo, error) {
+	cmdline, err := GetProcessCmdline(pid)
+	if err != nil || cmdline == "" {
+		return nil, err
+	}
+	info := ProcessInfo{Pid: pid, Cmdline: cmdline}
+
+	comm, fields, err := readProcessStat(pid)
+	if err != nil {
+		return nil, err
+	}
+	info.Comm = comm
+	info.Ppid = fields[statPpidIndex]
+	if info.StartTime, err = strconv.ParseUint(fields[statStartTimeIndex], 10, 64); err != nil {
+		return nil, fmt.Errorf("trans process %d starttime to int failed: %v", pid, err)
+	}
+
+	statusData, err := ioutil.ReadFile(fmt.Sprintf("/proc/%d/status", pid))
+	if err != nil {
+		return nil, err
+	}
+	for _, line := range strings.Split(string(statusData), "\n") {
+		// 行格式为：Uid:	0	0	0	0，第一个为真实uid。
+		if fields := strings.Fields(line); len(fields) > 1 && fields[0] == "Uid:" {
+			info.UID = fields[1]
+			break
+		}
+	}
+
+	cgroupData, err := ioutil.ReadFile(fmt.Sprintf("/proc/%d/cgroup", pid))
+	if err != nil {
+		return nil, err
+	}
+	for _, line := range strings.Split(strings.TrimSpace(string(cgroupData)), "\n") {
+		// 行格式为：hierarchy-ID:controller-list:cgroup-path。
+		if parts := strings.SplitN(line, ":", 3); len(parts) == 3 {
+			info.Cgroups = append(info.Cgroups, parts[2])
+		}
+	}
+	return &info, nil
+}
+
+func (s *ProcessSelector) isMatch(info *ProcessInfo) bool {
+	if s.name != "" && s.name != info.Comm && s.name != filepath.Base(strings.Fields(info.Cmdline)[0]) {
+		return false
+	}
+	if s.cmdlineRegex != nil && !s.cmdlineRegex.MatchString(info.Cmdline) {
+		return false
+	}
+	if s.uid != "" && s.uid != info.UID {
+		return false
+	}
+	if s.ppid != "" && s.ppid != info.Ppid {
+		return false
+	}
+	if s.cgroup != "" && !s.isInCgroup(info) {
+		return false
+	}
+	if s.unit != "" && !s.isInUnit(info) {
+		return false
+	}
+	return true
+}
+
+// isInCgroup 判断进程是否位于--cgroup指定的cgroup或其子cgroup中，任一层级匹配即可。
+func (s *ProcessSelector) isInCgroup(info *ProcessInfo) bool {
+	cgroup := strings.TrimSuffix(s.cgroup, "/")
+	for _, path := range info.Cgroups {
+		if path == cgroup || strings.HasPrefix(path, cgroup+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// isInUnit 判断进程是否属于systemd服务，systemd为每个服务创建名称为服务名的cgroup。
+func (s *ProcessSelector) isInUnit(info *ProcessInfo) bool {
+	for _, path := range info.Cgroups {
+		for _, name := range strings.Split(path, "/") {
+			if name == s.unit {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// MatchProcesses 遍历/proc获取所有匹配的进程，排除arsenal-os自身和其他arsenal-os进程，
+// 如：启动命令中包含选择参数的keeper。
+func (s *ProcessSelector) MatchProcesses() ([]*ProcessInfo, error) {
+	procList, err := ioutil.ReadDir("/proc")
+	if err != nil {
+		return nil, fmt.Errorf("read /proc failed: %v", err)
+	}
+	selfExe, err := os.Executable()
+	if err != nil {
+		return nil, fmt.Errorf("get arsenal-os executable path failed: %v", err)
+	}
+
+	var matched []*ProcessInfo
+	for _, proc := range procList {
+		pid, err := strconv.Atoi(proc.Name())
+		if err != nil || pid == os.Getpid() {
+			continue
+		}
+		if exe, err := os.Readlink(fmt.Sprintf("/proc/%d/exe", pid)); err == nil && exe == selfExe {
+			continue
+		}
+		// 遍历过程中进程可能已经退出，忽略读取失败的进程。
+		info, err := ReadProcessInfo(pid)
+		if err != nil || info == nil {
+			continue
+		}
+		if s.isMatch(info) {
+			matched = append(matched, info)
+		}
+	}
+	return matched, nil
+}
+
+// SelectProcesses 按照--select从匹配的进程中选择目标。
+func (s *ProcessSelector) SelectProcesses() ([]int, error) {
+	matched, err := s.MatchProcesses()
+	if err != nil {
+		return nil, err
+	}
+	if len(matched) == 0 {
+		return nil, errors.New("no process matches the selector")
+	}
+
+	switch s.selectMode {
+	case "one":
+		if len(matched) != 1 {
+			return nil, fmt.Errorf("%d processes match the selector, expect only one", len(matched))
+		}
+	case "random":
+		random := rand.New(rand.NewSource(time.Now().UnixNano()))
+		random.Shuffle(len(matched), func(i, j int) { matched[i], matched[j] = matched[j], matched[i] })
+	case "oldest", "newest":
+		sort.Slice(matched, func(i, j int) bool {
+			if s.selectMode == "oldest" {
+				return matched[i].StartTime < matched[j].StartTime
+			}
+			return matched[i].StartTime > matched[j].StartTime
+		})
+	}
+	if s.selectMode != "all" && s.selectMode != "one" && len(matched) > s.count {
+		matched = matched[:s.count]
+	}
+
+	pids := make([]int, 0, len(matched))
+	for _, info := range matched {
+		pids = append(pids, info.Pid)
+	}
+	return pids, nil
+}
+
+// GetTargetProcesses 获取故障注入的目标进程，指定--pid时直接使用pid，否则通过选择器筛选。
+func GetTargetProcesses(flagsMap map[string]string) ([]int, error) {
+	if _, ok := flagsMap["pid"]; ok {
+		return getProcessPidList(flagsMap)
+	}
+	selector, err := NewProcessSelector(flagsMap)
+	if err != nil {
+		return nil, err
+	}
+	return selector.SelectProcesses()
+}
+
+// IsTargetSpecified 判断是否指定了目标进程，未指定时部分故障作用于整个系统。
+func IsTargetSpecified(flagsMap map[string]string) bool {
+	for _, name := range selectorFlags {
+		if _, ok := flagsMap[name]; ok && name != "select" && name != "count" {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,73 @@
+/*
+Copyright 2023 Sangfor Technologies Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package util
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+const (
+	kib = 1 << 10
+	mib = 1 << 20
+	gib = 1 << 30
+	tib = 1 << 40
+)
+
+// ParseSize 将带单位的容量字符串转换成字节数，单位支持K、M、G、T(以1024为进制，
+// 可带B或iB后缀，大小写不敏感)，不带单位时单位为字节，如：512K、50M、1.5G。
+func ParseSize(input string) (uint64, error) {
+	re := regexp.MustCompile(`^(\d+(\.\d+)?)([kmgt]?)(i?b)?$`)
+	matches := re.FindStringSubmatch(strings.ToLower(strings.TrimSpace(input)))
+	if matches == nil {
+		return 0, fmt.Errorf("invalid size: %s", input)
+	}
+
+	value, err := strconv.ParseFloat(matches[1], 64)
+	if err != nil {
+		return 0, fmt.Errorf("trans size(%s) to float failed: %v", input, err)
+	}
+	switch matches[3] {
+	case "k":
+		value *= kib
+	case "m":
+		value *= mib
+	case "g":
+		value *= gib
+	case "t":
+		value *= tib
+	}
+	return uint64(value), nil
+}
+
+// FormatSize 将字节数转换成便于阅读的字符串，如：1.50G。
+func FormatSize(size uint64) string {
+	switch {
+	case size >= tib:
+		return fmt.Sprintf("%.2fT", float64(size)/tib)
+	case size >= gib:
+		return fmt.Sprintf("%.2fG", float64(size)/gib)
+	case size >= mib:
+		return fmt.Sprintf("%.2fM", float64(size)/mib)
+	case size >= kib:
+		return fmt.Sprintf("%.2fK", float64(size)/kib)
+	default:
+		return fmt.Sprintf("%dB", size)
+	}
+}
@@ -0,0 +1,91 @@
+/*
+Copyright 2023 Sangfor Technologies Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package util
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// stateDir 故障注入前原始状态的保存目录，注入和清理分别运行在不同的进程中，
+// 需要恢复的信息通过该目录在进程间传递；目录位于tmpfs中，系统重启后随内核状态一起失效。
+var stateDir = "/var/run/arsenal-os"
+
+const (
+	stateDirPerm  = os.FileMode(0700)
+	stateFilePerm = os.FileMode(0600)
+)
+
+func stateFilePath(name string) string {
+	return filepath.Join(stateDir, fmt.Sprintf("%s.json", name))
+}
+
+// StateIsExist 判断名称为name的状态记录是否存在。
+func StateIsExist(name string) bool {
+	return FileIsExist(stateFilePath(name))
+}
+
+// SaveState 将value序列化成json后保存为名称为name的状态记录，已存在的记录将被覆盖。
+func SaveState(name string, value interface{}) error {
+	if err := os.MkdirAll(stateDir, stateDirPerm); err != nil {
+		return fmt.Errorf("create state dir: %s failed: %v", stateDir, err)
+	}
+
+	data, err := json.Marshal(value)
+	if err != nil {
+		return fmt.Errorf("marshal state %s failed: %v", name, err)
+	}
+
+	// 先写临时文件再重命名，避免进程被kill时留下不完整的记录。
+	path := stateFilePath(name)
+	tmpPath := fmt.Sprintf("%s.tmp", path)
+	if err := ioutil.WriteFile(tmpPath, data, stateFilePerm); err != nil {
+		return fmt.Errorf("write state file: %s failed: %v", tmpPath, err)
+	}
+	if err := os.Rename(tmpPath, path); err != nil {
+		return fmt.Errorf("rename state file: %s failed: %v", tmpPath, err)
+	}
+	return nil
+}
+
+// LoadState 读取名称为name的状态记录并反序列化到value中。
+func LoadState(name string, value interface{}) error {
+	path := stateFilePath(name)
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("read state file: %s failed: %v", path, err)
+	}
+	if err := json.Unmarshal(data, value); err != nil {
+		return fmt.Errorf("unmarshal state %s failed: %v", name, err)
+	}
+	return nil
+}
+
+// RemoveState 删除名称为name的状态记录，记录不存在时直接返回。
+func RemoveState(name string) error {
+	path := stateFilePath(name)
+	if !FileIsExist(path) {
+		return nil
+	}
+	if err := os.Remove(path); err != nil {
+		return fmt.Errorf("remove state file: %s failed: %v", path, err)
+	}
+	return nil
+}
@@ -26,6 +26,23 @@ import (
 	"time"
 )
 
+const (
+	// SysrqTriggerPath 写入sysrq命令字符即可触发对应的内核动作，如：f触发OOM killer。
+	SysrqTriggerPath = "/proc/sysrq-trigger"
+	// SleepForever sleep命令可接受的最大秒数，用于创建长期存活的子进程。
+	SleepForever = "2147483647"
+)
+
+// IsValidValue 判断参数值是否为可选值之一。
+func IsValidValue(value string, validValues []string) bool {
+	for _, validValue := range validValues {
+		if value == validValue {
+			return true
+		}
+	}
+	return false
+}
+
 // FileIsExist 判断文件是否存在。
 func FileIsExist(path string) bool {
 	_, ret := os.Stat(path)